@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tortis/netreg/devm"
+)
+
+const (
+	ACTION_LOGIN        = "login"
+	ACTION_LOGIN_FAILED = "login-failed"
+	ACTION_ADD          = "add"
+	ACTION_UPDATE       = "update"
+	ACTION_REMOVE       = "remove"
+	ACTION_RESTORE      = "restore"
+	ACTION_ENABLE       = "enable"
+	ACTION_DISABLE      = "disable"
+	ACTION_RESTART      = "restart"
+	ACTION_RESOLVE      = "resolve"
+	ACTION_ROTATE_KEY   = "rotate-key"
+	ACTION_TOKEN_REUSE  = "token-reuse"
+	ACTION_LOGOUT       = "logout"
+	ACTION_REVOKE       = "revoke"
+)
+
+// Event is a single entry in the audit log. Before and After hold the
+// state of the device on either side of the change, when there is one.
+type Event struct {
+	Time     time.Time    `json:"time"`
+	Actor    string       `json:"actor"`
+	Action   string       `json:"action"`
+	MAC      string       `json:"mac,omitempty"`
+	ClientIP string       `json:"clientIP,omitempty"`
+	Before   *devm.Device `json:"before,omitempty"`
+	After    *devm.Device `json:"after,omitempty"`
+	Detail   string       `json:"detail,omitempty"`
+}
+
+// Filter selects events from the log. Empty fields match everything.
+type Filter struct {
+	Actor  string
+	MAC    string
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f *Filter) Match(e *Event) bool {
+	if f.Actor != "" && f.Actor != e.Actor {
+		return false
+	}
+	if f.MAC != "" && !strings.EqualFold(f.MAC, e.MAC) {
+		return false
+	}
+	if f.Action != "" && f.Action != e.Action {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Log is an append-only audit log stored as one JSON event per line.
+type Log struct {
+	path string
+	file *os.File
+	sync.Mutex
+}
+
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, file: file}, nil
+}
+
+func (l *Log) Record(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Query reads the log from the beginning and returns the events matching f,
+// oldest first.
+func (l *Log) Query(f Filter) ([]Event, error) {
+	l.Lock()
+	defer l.Unlock()
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make([]Event, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a torn line rather than hiding the rest of the log
+			continue
+		}
+		if f.Match(&e) {
+			result = append(result, e)
+		}
+	}
+	return result, scanner.Err()
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
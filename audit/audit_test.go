@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tortis/netreg/devm"
+)
+
+func TestRecordAndQuery(t *testing.T) {
+	os.Remove("TestAudit.log")
+	l, err := Open("TestAudit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := &devm.Device{
+		Name:    "dfindley-laptop",
+		Owner:   "dfindley",
+		Device:  "laptop",
+		MAC:     "10:68:3f:fd:e9:1d",
+		Enabled: true,
+	}
+	start := time.Now().Add(-time.Second)
+	l.Record(Event{Actor: "dfindley", Action: ACTION_LOGIN, ClientIP: "10.0.0.1"})
+	l.Record(Event{Actor: "dfindley", Action: ACTION_ADD, MAC: dev.MAC, After: dev})
+	l.Record(Event{Actor: "admin", Action: ACTION_REMOVE, MAC: dev.MAC, Before: dev})
+	l.Close()
+
+	// Reopen to make sure events survive
+	l, err = Open("TestAudit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	all, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatal("Recorded 3 events, but query returned ", len(all))
+	}
+
+	byUser, _ := l.Query(Filter{Actor: "dfindley"})
+	if len(byUser) != 2 {
+		t.Fatal("Expected 2 events for dfindley, got ", len(byUser))
+	}
+
+	byMAC, _ := l.Query(Filter{MAC: "10:68:3F:FD:E9:1D"})
+	if len(byMAC) != 2 {
+		t.Fatal("Expected 2 events for the MAC, got ", len(byMAC))
+	}
+	if byMAC[1].Before == nil || *byMAC[1].Before != *dev {
+		t.Fatal("Removed device state was not recorded.")
+	}
+
+	byAction, _ := l.Query(Filter{Action: ACTION_LOGIN, Since: start})
+	if len(byAction) != 1 || byAction[0].ClientIP != "10.0.0.1" {
+		t.Fatal("Expected a single login event with client IP.")
+	}
+
+	future, _ := l.Query(Filter{Since: time.Now().Add(time.Hour)})
+	if len(future) != 0 {
+		t.Fatal("Events were returned for a future time range.")
+	}
+
+	os.Remove("TestAudit.log")
+}
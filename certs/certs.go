@@ -0,0 +1,212 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client certificate fields that can name a netreg user.
+const (
+	IDENTITY_CN    = "cn"
+	IDENTITY_EMAIL = "email"
+	IDENTITY_DNS   = "dns"
+)
+
+var ERR_NO_IDENTITY = errors.New("Certificate does not name a user")
+
+// How often the certificate files are checked for changes. Polling follows
+// symlinks, so it also notices certbot style renewals that swap the target
+// of a link rather than writing the file itself.
+const pollInterval = 10 * time.Second
+
+// Reloader serves a certificate from a PEM certificate and key file pair and
+// loads it again whenever either file changes.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modified time.Time
+	stopChan chan bool
+	sync.RWMutex
+}
+
+func NewReloader(certFile, keyFile string) *Reloader {
+	return &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stopChan: make(chan bool),
+	}
+}
+
+// Load reads the certificate and key. On error the certificate already
+// loaded, if any, stays in use.
+func (r *Reloader) Load() error {
+	modified, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.cert = &cert
+	r.modified = modified
+	return nil
+}
+
+func (r *Reloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Start checks the files for changes until Stop is called.
+func (r *Reloader) Start() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.reloadIfChanged()
+			case <-r.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (r *Reloader) Stop() {
+	close(r.stopChan)
+}
+
+func (r *Reloader) reloadIfChanged() {
+	modified, err := r.lastModified()
+	if err != nil {
+		// Probably part way through a renewal, try again next time
+		return
+	}
+	r.RLock()
+	changed := !modified.Equal(r.modified)
+	r.RUnlock()
+	if !changed {
+		return
+	}
+	err = r.Load()
+	if err != nil {
+		slog.Error("Could not reload TLS certificate", "file", r.certFile, "error", err)
+		return
+	}
+	slog.Info("Reloaded TLS certificate", "file", r.certFile)
+}
+
+// GetCertificate is for use as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion turns a TLS version such as "1.2" into its tls constant.
+func ParseVersion(version string) (uint16, error) {
+	v, ok := versions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// ParseCiphers turns a comma separated list of cipher suite names, as
+// listed by tls.CipherSuites, into their IDs. An empty list returns nil,
+// which leaves the choice to crypto/tls. Only secure suites are accepted.
+func ParseCiphers(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadPool reads a PEM bundle of CA certificates.
+func LoadPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// CheckIdentity makes sure field is one of the IDENTITY_* constants.
+func CheckIdentity(field string) error {
+	switch field {
+	case IDENTITY_CN, IDENTITY_EMAIL, IDENTITY_DNS:
+		return nil
+	}
+	return fmt.Errorf("unknown client certificate identity %q", field)
+}
+
+// Identity returns the username a client certificate stands for, taken from
+// the subject common name, the local part of the first email address, or the
+// first DNS name.
+func Identity(cert *x509.Certificate, field string) (string, error) {
+	var name string
+	switch field {
+	case IDENTITY_CN:
+		name = cert.Subject.CommonName
+	case IDENTITY_EMAIL:
+		if len(cert.EmailAddresses) > 0 {
+			name = strings.SplitN(cert.EmailAddresses[0], "@", 2)[0]
+		}
+	case IDENTITY_DNS:
+		if len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+	default:
+		return "", CheckIdentity(field)
+	}
+	if name == "" {
+		return "", ERR_NO_IDENTITY
+	}
+	return name, nil
+}
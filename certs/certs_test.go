@@ -0,0 +1,136 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate for name to the test files.
+func writeCert(t *testing.T, name string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile("TestCert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile("TestKey.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func commonName(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	defer os.Remove("TestCert.pem")
+	defer os.Remove("TestKey.pem")
+	writeCert(t, "first")
+
+	r := NewReloader("TestCert.pem", "TestKey.pem")
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if commonName(t, r) != "first" {
+		t.Fatal("Loaded the wrong certificate.")
+	}
+
+	// Unchanged files are not read again
+	r.reloadIfChanged()
+	if commonName(t, r) != "first" {
+		t.Fatal("Certificate changed without the files changing.")
+	}
+
+	writeCert(t, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes("TestCert.pem", later, later)
+	r.reloadIfChanged()
+	if commonName(t, r) != "second" {
+		t.Fatal("Certificate was not reloaded after the files changed.")
+	}
+
+	// A broken key leaves the last good certificate in place
+	ioutil.WriteFile("TestKey.pem", []byte("not a key"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes("TestKey.pem", later, later)
+	r.reloadIfChanged()
+	if commonName(t, r) != "second" {
+		t.Fatal("A bad key replaced the working certificate.")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	v, err := ParseVersion("1.3")
+	if err != nil || v != tls.VersionTLS13 {
+		t.Fatal("Could not parse TLS 1.3: ", err)
+	}
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Fatal("Expected an unknown version to be rejected.")
+	}
+
+	ids, err := ParseCiphers("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatal("Cipher suites were not parsed correctly: ", ids)
+	}
+	if _, err := ParseCiphers("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Fatal("Expected an insecure cipher suite to be rejected.")
+	}
+	if ids, err := ParseCiphers(""); ids != nil || err != nil {
+		t.Fatal("An empty list should leave the default suites.")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "provisioner"},
+		EmailAddresses: []string{"dfindley@math.ou.edu"},
+	}
+	tests := map[string]string{
+		IDENTITY_CN:    "provisioner",
+		IDENTITY_EMAIL: "dfindley",
+	}
+	for field, want := range tests {
+		name, err := Identity(cert, field)
+		if err != nil || name != want {
+			t.Fatal("Wrong identity from", field, ":", name, err)
+		}
+	}
+	if _, err := Identity(cert, IDENTITY_DNS); err != ERR_NO_IDENTITY {
+		t.Fatal("Expected a missing DNS name to be an error, got", err)
+	}
+	if _, err := Identity(cert, "serial"); err == nil {
+		t.Fatal("Expected an unknown field to be rejected.")
+	}
+}
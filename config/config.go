@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ENV_PREFIX starts the environment variables that override settings.
+// NETREG_WEB_PORT sets web-port, for example.
+const ENV_PREFIX = "NETREG_"
+
+var ERR_UNKNOWN_SETTING = errors.New("unknown setting")
+
+// Values maps flag names to the text they should be set to. Settings in the
+// config file use the same names as the command line flags.
+type Values map[string]string
+
+// Read parses a TOML config file of top level settings. Lists are joined with
+// commas, which is how list flags are given on the command line.
+func Read(file string) (Values, error) {
+	raw := make(map[string]interface{})
+	if _, err := toml.DecodeFile(file, &raw); err != nil {
+		return nil, err
+	}
+	v := make(Values)
+	for name, value := range raw {
+		s, err := format(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", file, name, err)
+		}
+		v[name] = s
+	}
+	return v, nil
+}
+
+func format(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			s, err := format(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value of type %T", value)
+}
+
+// Environ picks the settings out of environment variables given as
+// KEY=value pairs, as returned by os.Environ.
+func Environ(environ []string) Values {
+	v := make(Values)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, ENV_PREFIX) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, ENV_PREFIX), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.ToLower(strings.Replace(parts[0], "_", "-", -1))
+		v[name] = parts[1]
+	}
+	return v
+}
+
+// Merge copies o into v, replacing settings that are in both.
+func (v Values) Merge(o Values) {
+	for name, value := range o {
+		v[name] = value
+	}
+}
+
+// Check makes sure every setting names a flag in fs.
+func (v Values) Check(fs *flag.FlagSet) error {
+	for _, name := range v.names() {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%w %q", ERR_UNKNOWN_SETTING, name)
+		}
+	}
+	return nil
+}
+
+// Apply sets the flags in fs. It stops at the first unknown setting or
+// value the flag rejects.
+func (v Values) Apply(fs *flag.FlagSet) error {
+	if err := v.Check(fs); err != nil {
+		return err
+	}
+	for _, name := range v.names() {
+		if err := fs.Set(name, v[name]); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", v[name], name, err)
+		}
+	}
+	return nil
+}
+
+// Changed returns the settings that differ from the current value of their
+// flag in fs. Values are compared after parsing, so "48h" matches a duration
+// flag holding 48h0m0s.
+func (v Values) Changed(fs *flag.FlagSet) []string {
+	var changed []string
+	for _, name := range v.names() {
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		parsed, ok := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		if !ok || parsed.Set(v[name]) != nil || parsed.String() != f.Value.String() {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// names returns the settings in a fixed order so errors are repeatable.
+func (v Values) names() []string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadAndApply(t *testing.T) {
+	data := `
+web-port = 8443
+hosthtml = true
+trash-retention = "48h"
+admins = ["dfindley", "root"]
+`
+	if err := ioutil.WriteFile("TestConfig.toml", []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("TestConfig.toml")
+
+	v, err := Read("TestConfig.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["web-port"] != "8443" || v["hosthtml"] != "true" || v["admins"] != "dfindley,root" {
+		t.Fatal("Config values were not read correctly:", v)
+	}
+
+	// The environment overrides the file
+	v.Merge(Environ([]string{"NETREG_WEB_PORT=9000", "NETREGX=1", "HOME=/root"}))
+	if v["web-port"] != "9000" {
+		t.Fatal("Environment did not override the file:", v["web-port"])
+	}
+	if len(v) != 4 {
+		t.Fatal("Unrelated environment variables were picked up:", v)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("web-port", 3000, "")
+	hostHTML := fs.Bool("hosthtml", false, "")
+	retention := fs.Duration("trash-retention", time.Hour, "")
+	admins := fs.String("admins", "", "")
+	if err := v.Apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 9000 || !*hostHTML || *retention != 48*time.Hour || *admins != "dfindley,root" {
+		t.Fatal("Flags were not set from the config:", *port, *hostHTML, *retention, *admins)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("web-port", 3000, "")
+	fs.Duration("trash-retention", 48*time.Hour, "")
+	fs.String("htmldir", "./public", "")
+
+	changed := Values{"web-port": "3000", "trash-retention": "2880m", "htmldir": "/opt/netreg/public"}.Changed(fs)
+	if len(changed) != 1 || changed[0] != "htmldir" {
+		t.Fatal("Expected only htmldir to have changed:", changed)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("web-port", 3000, "")
+
+	err := Values{"web-prot": "80"}.Apply(fs)
+	if !errors.Is(err, ERR_UNKNOWN_SETTING) {
+		t.Fatal("Expected an unknown setting error, got", err)
+	}
+	err = Values{"web-port": "eighty"}.Apply(fs)
+	if err == nil {
+		t.Fatal("Expected an invalid value to be rejected.")
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	data := "[ldap]\nserver = \"localhost\"\n"
+	if err := ioutil.WriteFile("TestConfig.toml", []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("TestConfig.toml")
+
+	if _, err := Read("TestConfig.toml"); err == nil {
+		t.Fatal("Expected tables to be rejected.")
+	}
+}
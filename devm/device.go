@@ -10,12 +10,26 @@ type Device struct {
 	Device  string
 	MAC     string
 	Enabled bool
+	// Version is the registry revision at which the device last changed.
+	Version int64
 }
 
 func (d *Device) String() string {
 	return fmt.Sprintf("OWNER: %s DEVICE: %s (%s)", d.Owner, d.Device, d.MAC)
 }
 
+// ETag is the HTTP entity tag for the current version of the device.
+func (d *Device) ETag() string {
+	return fmt.Sprintf("\"%d\"", d.Version)
+}
+
+// sameAs compares everything but the version.
+func (d *Device) sameAs(o *Device) bool {
+	a, b := *d, *o
+	a.Version, b.Version = 0, 0
+	return a == b
+}
+
 type sortableKey struct {
 	Name    string
 	MAC     string
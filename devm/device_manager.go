@@ -2,145 +2,319 @@ package devm
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
-	"os"
 	"os/exec"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+)
+
+const (
+	BEGIN_MARKER = "# BEGIN NETREG"
+	END_MARKER   = "# END NETREG"
+)
 
-	"github.com/go-fsnotify/fsnotify"
+// How a device manager lays out the file it owns around the host records.
+const (
+	// The whole dhcpd.conf: a preamble, the hosts, and the closing brace of
+	// the subnet they live in.
+	layoutFull = iota
+	// An include file holding nothing but host records.
+	layoutInclude
+	// Only the lines between BEGIN_MARKER and END_MARKER in dhcpd.conf.
+	layoutMarkers
 )
 
 type DeviceManager struct {
-	devices     map[string]*Device
-	keys        []sortableKey
-	configFile  string
-	fileHead    string
-	restartChan chan bool
-	stopChan    chan bool
-	watcher     *fsnotify.Watcher
-	ignoreWrite bool
+	devices    map[string]*Device
+	keys       []sortableKey
+	configFile string
+	layout     int
+	fileHead   string
+	fileTail   string
+	loadErr    error
+	revision   int64
+	// The file as netreg last loaded or saved it, for merging external edits
+	fileHash      [sha256.Size]byte
+	base          map[string]*Device
+	conflicts     map[string]*Conflict
+	restartChan   chan bool
+	stopChan      chan bool
+	stopped       chan bool
+	watchStopped  chan bool
+	watchStatus   WatcherStatus
+	restartStatus RestartStatus
+	statusLock    sync.Mutex
+	events        publisher
+	// OnRestart, if set, is called after every attempt to restart dhcpd
+	// with the error returned by the restart command.
+	OnRestart func(err error)
+	// ConflictsFile, if set, keeps unresolved merge conflicts so that the
+	// side not in effect survives a restart.
+	ConflictsFile string
+	// OnChange, if set, is called with the device events of every change
+	// to the registry, made through Update or by merging an edit of the
+	// config file. Unlike subscribers it sees every event; it is called
+	// with the lock held, so it must not call back into the manager.
+	OnChange func(events []Event)
 	sync.RWMutex
 }
 
 func NewDeviceManager(configFile string) *DeviceManager {
 	return &DeviceManager{
-		devices:     make(map[string]*Device),
-		keys:        make([]sortableKey, 0),
-		configFile:  configFile,
-		restartChan: make(chan bool, 256),
-		stopChan:    make(chan bool),
+		devices:      make(map[string]*Device),
+		keys:         make([]sortableKey, 0),
+		configFile:   configFile,
+		layout:       layoutFull,
+		fileTail:     "}\n",
+		base:         make(map[string]*Device),
+		conflicts:    make(map[string]*Conflict),
+		restartChan:  make(chan bool, 256),
+		stopChan:     make(chan bool),
+		stopped:      make(chan bool),
+		watchStopped: make(chan bool),
 	}
 }
 
+// NewIncludeDeviceManager creates a device manager that owns only a
+// dedicated include file of host declarations, referenced from the main
+// dhcpd.conf by an include statement. Unlike NewDeviceManager it does not
+// close the enclosing subnet block when saving.
+func NewIncludeDeviceManager(includeFile string) *DeviceManager {
+	dm := NewDeviceManager(includeFile)
+	dm.layout = layoutInclude
+	dm.fileTail = ""
+	return dm
+}
+
+// NewMarkedDeviceManager creates a device manager that owns only the lines
+// between BEGIN_MARKER and END_MARKER in configFile. Everything outside the
+// markers is written back verbatim.
+func NewMarkedDeviceManager(configFile string) *DeviceManager {
+	dm := NewDeviceManager(configFile)
+	dm.layout = layoutMarkers
+	dm.fileTail = ""
+	return dm
+}
+
+// Load reads the config file, replacing all devices in the manager. If it
+// fails, Save refuses to write until a later Load succeeds, so a broken file
+// is never overwritten with an empty host list.
 func (m *DeviceManager) Load() error {
+	m.Lock()
+	defer m.Unlock()
+
 	// Dump device map
+	old := m.devices
 	m.devices = make(map[string]*Device)
 	m.keys = make([]sortableKey, 0)
 	m.fileHead = ""
 
-	m.Lock()
-	defer m.Unlock()
-	file, err := os.Open(m.configFile)
-	defer file.Close()
+	data, err := ioutil.ReadFile(m.configFile)
+	if err == nil {
+		err = m.parse(data)
+	}
+	m.loadErr = err
+	m.renumber(old)
+	if err != nil {
+		return err
+	}
+	m.remember(data)
+	err = m.loadConflicts()
 	if err != nil {
 		return err
 	}
+	m.publish(Event{Type: EVENT_RELOADED, Revision: m.revision})
+	return nil
+}
+
+// parse reads the devices, head and tail out of the contents of the config
+// file. The caller must hold the lock.
+func (m *DeviceManager) parse(data []byte) error {
+	if m.layout == layoutMarkers {
+		return m.parseMarked(data)
+	}
+	return m.parseFile(data)
+}
+
+// renumber starts a new revision for a freshly loaded registry. Devices that
+// did not change since old keep their version so outstanding ETags stay
+// valid. The caller must hold the lock.
+func (m *DeviceManager) renumber(old map[string]*Device) {
+	m.revision++
+	for mac, d := range m.devices {
+		if o := old[mac]; o != nil && o.sameAs(d) {
+			d.Version = o.Version
+		} else {
+			d.Version = m.revision
+		}
+	}
+}
+
+// remember records data as the last known contents of the config file, and
+// the current devices as the base for merging later edits to it. The caller
+// must hold the lock.
+func (m *DeviceManager) remember(data []byte) {
+	m.fileHash = sha256.Sum256(data)
+	m.base = make(map[string]*Device, len(m.devices))
+	for mac, d := range m.devices {
+		m.base[mac] = d
+	}
+}
+
+// parseFile reads a full config or include file. Everything up to the first
+// host record is kept as the file head. The caller must hold the lock.
+func (m *DeviceManager) parseFile(data []byte) error {
 	lineNumber := 0
 	readingHead := true
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(bytes.NewReader(data))
 	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
 		lineNumber++
-		trimmedLine := strings.TrimSpace(line)
-		if len(trimmedLine) < 4 {
-			if readingHead {
-				m.fileHead += line
-			}
-			continue
-		}
-		if trimmedLine[:4] != "host" && trimmedLine[:1] != "#" {
+		if !isHostLine(line) {
 			if readingHead {
 				m.fileHead += line
 			}
 			continue
 		}
 		readingHead = false
-		name := new(string)
-		MACString := new(string)
-		enabled := true
-
-		// Scan enabled device
-		if trimmedLine[:4] == "host" {
-			_, err := fmt.Sscanf(trimmedLine, "host %s { hardware ethernet %s }", name, MACString)
-			if err != nil {
-				log.Println("Failed to parse record on line ", lineNumber)
-				continue
+		if d := parseHostLine(line, lineNumber); d != nil {
+			m.Add(d)
+		}
+	}
+	return nil
+}
+
+// parseMarked reads the host records between the markers, keeping the rest
+// of the file verbatim. The caller must hold the lock.
+func (m *DeviceManager) parseMarked(data []byte) error {
+	lines := splitLines(string(data))
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case BEGIN_MARKER:
+			if begin != -1 {
+				return fmt.Errorf("%s: duplicate %q marker on lines %d and %d, netreg will not manage the file until there is exactly one", m.configFile, BEGIN_MARKER, begin+1, i+1)
 			}
-		} else {
-			_, err := fmt.Sscanf(trimmedLine, "# host %s { hardware ethernet %s }", name, MACString)
-			if err != nil {
-				log.Println("Failed to parse disabled record on line ", lineNumber)
-				continue
+			begin = i
+		case END_MARKER:
+			if end != -1 {
+				return fmt.Errorf("%s: duplicate %q marker on lines %d and %d, netreg will not manage the file until there is exactly one", m.configFile, END_MARKER, end+1, i+1)
 			}
-			enabled = false
+			end = i
 		}
+	}
+	if begin == -1 {
+		return fmt.Errorf("%s: missing %q marker, add it on the line before the host records netreg should manage", m.configFile, BEGIN_MARKER)
+	}
+	if end == -1 {
+		return fmt.Errorf("%s: missing %q marker, add it on the line after the host records netreg should manage", m.configFile, END_MARKER)
+	}
+	if end < begin {
+		return fmt.Errorf("%s: %q on line %d comes before %q on line %d", m.configFile, END_MARKER, end+1, BEGIN_MARKER, begin+1)
+	}
 
-		*MACString = strings.TrimRight(*MACString, ";")
-		_, err = net.ParseMAC(*MACString)
-		if err != nil {
-			log.Println("Failed to parse MAC address on line ", lineNumber)
+	m.fileHead = strings.Join(lines[:begin+1], "")
+	m.fileTail = strings.Join(lines[end:], "")
+	for i := begin + 1; i < end; i++ {
+		if strings.TrimSpace(lines[i]) == "" {
 			continue
 		}
+		if !isHostLine(lines[i]) {
+			slog.Warn("Dropping non-host line inside the managed section", "file", m.configFile, "line", i+1)
+			continue
+		}
+		if d := parseHostLine(lines[i], i+1); d != nil {
+			m.Add(d)
+		}
+	}
+	return nil
+}
+
+// isHostLine reports whether line is a host record, enabled or commented out.
+func isHostLine(line string) bool {
+	trimmedLine := strings.TrimSpace(line)
+	if len(trimmedLine) < 4 {
+		return false
+	}
+	// Plain comments are not disabled hosts
+	isDisabledHost := trimmedLine[:1] == "#" && strings.HasPrefix(strings.TrimSpace(trimmedLine[1:]), "host")
+	return trimmedLine[:4] == "host" || isDisabledHost
+}
 
-		d := &Device{
-			Name:    *name,
-			MAC:     *MACString,
-			Enabled: enabled,
+// parseHostLine parses a host record, logging and returning nil if it is
+// malformed.
+func parseHostLine(line string, lineNumber int) *Device {
+	trimmedLine := strings.TrimSpace(line)
+	name := new(string)
+	MACString := new(string)
+	enabled := true
+
+	// Scan enabled device
+	if trimmedLine[:4] == "host" {
+		_, err := fmt.Sscanf(trimmedLine, "host %s { hardware ethernet %s }", name, MACString)
+		if err != nil {
+			slog.Warn("Failed to parse record", "line", lineNumber)
+			return nil
 		}
-		// Attempt to parse username from device name
-		nameTokens := strings.SplitN(*name, "-", 2)
-		if len(nameTokens) > 1 {
-			d.Owner = nameTokens[0]
-			d.Device = nameTokens[1]
-		} else {
-			d.Owner = "UNKNOWN"
-			d.Device = nameTokens[0]
+	} else {
+		_, err := fmt.Sscanf(trimmedLine, "# host %s { hardware ethernet %s }", name, MACString)
+		if err != nil {
+			slog.Warn("Failed to parse disabled record", "line", lineNumber)
+			return nil
 		}
+		enabled = false
+	}
 
-		m.Add(d)
+	*MACString = strings.TrimRight(*MACString, ";")
+	_, err := net.ParseMAC(*MACString)
+	if err != nil {
+		slog.Warn("Failed to parse MAC address", "line", lineNumber, "mac", *MACString)
+		return nil
 	}
-	return nil
+
+	d := &Device{
+		Name:    *name,
+		MAC:     *MACString,
+		Enabled: enabled,
+	}
+	// Attempt to parse username from device name
+	nameTokens := strings.SplitN(*name, "-", 2)
+	if len(nameTokens) > 1 {
+		d.Owner = nameTokens[0]
+		d.Device = nameTokens[1]
+	} else {
+		d.Owner = "UNKNOWN"
+		d.Device = nameTokens[0]
+	}
+	return d
 }
 
 func (dm *DeviceManager) Start(dhcpdRestart string) {
 	// Restart device manager when necessary
 	go func() {
+		defer close(dm.stopped)
 		cmdPieces := strings.Split(dhcpdRestart, " ")
 		for {
 			// Prevent the DHCP service from restarting more than
 			// once per minute.
-			time.Sleep(time.Minute)
 			select {
-			case _ = <-dm.restartChan:
-				log.Println("Restarting DHCP service.")
-				// Don't let the file change while dhcpd is reloading
-				dm.Lock()
-				rp := exec.Command(cmdPieces[0], cmdPieces[1:]...)
-				err := rp.Run()
-				if err != nil {
-					log.Println(err)
-				}
-				// Clear the restartChannel
-				dm.restartChan = make(chan bool, 256)
-
-				dm.Unlock()
-			case _ = <-dm.stopChan:
-				log.Println("Stopping device manager.")
+			case <-time.After(time.Minute):
+			case <-dm.stopChan:
+				dm.flushRestart(cmdPieces)
+				return
+			}
+			select {
+			case <-dm.restartChan:
+				dm.restart(cmdPieces)
+			case <-dm.stopChan:
+				dm.flushRestart(cmdPieces)
 				return
 			}
 		}
@@ -148,62 +322,168 @@ func (dm *DeviceManager) Start(dhcpdRestart string) {
 
 	// Listen for changes in the config file
 	go func() {
-		var err error
-		dm.watcher, err = fsnotify.NewWatcher()
-		if err != nil {
-			log.Fatal("Could not create fswatcher: ", err)
-		}
-		err = dm.watcher.Add(dm.configFile)
-		if err != nil {
-			log.Fatal("Could not start watching config file: ", err)
-		}
-		for {
-			select {
-			case event := <-dm.watcher.Events:
-				log.Println("Watcher event: " + event.String())
-				// File is removed on edit
-				if event.Op == fsnotify.Remove {
-					if !dm.ignoreWrite {
-						log.Println("Detected config file edit (replaced)")
-					}
-					time.Sleep(time.Second)
-					dm.Load()
-					dm.watcher.Add(dm.configFile)
-				}
-
-				if event.Op == fsnotify.Write {
-					if !dm.ignoreWrite {
-						log.Println("Detected config file edit.")
-						dm.Load()
-					}
-				}
-			case err := <-dm.watcher.Errors:
-				log.Println("Watcher error: ", err)
-			case _ = <-dm.stopChan:
-				return
-			}
-		}
+		defer close(dm.watchStopped)
+		dm.watch()
 	}()
 }
 
+// restart runs the dhcpd restart command and reports how it went.
+func (dm *DeviceManager) restart(cmdPieces []string) {
+	slog.Info("Restarting DHCP service")
+	// Don't let the file change while dhcpd is reloading
+	dm.Lock()
+	rp := exec.Command(cmdPieces[0], cmdPieces[1:]...)
+	started := time.Now()
+	err := rp.Run()
+	took := time.Since(started)
+	if err != nil {
+		slog.Error("Failed to restart DHCP service", "command", strings.Join(cmdPieces, " "), "error", err)
+	}
+	// Saves made before the restart are covered by it
+	dm.drainRestarts()
+	dm.Unlock()
+
+	e := Event{Type: EVENT_RESTARTED, Duration: took}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	dm.statusLock.Lock()
+	dm.restartStatus = RestartStatus{Last: started, Duration: took, Error: e.Error}
+	dm.statusLock.Unlock()
+	dm.publish(e)
+	if dm.OnRestart != nil {
+		dm.OnRestart(err)
+	}
+}
+
+// drainRestarts empties the restart queue and reports whether anything was
+// waiting in it. The caller must hold the lock.
+func (dm *DeviceManager) drainRestarts() bool {
+	pending := false
+	for {
+		select {
+		case <-dm.restartChan:
+			pending = true
+		default:
+			return pending
+		}
+	}
+}
+
+// flushRestart runs a restart still owed for saved changes when the manager
+// stops, once the watcher has finished any reload it was waiting on.
+func (dm *DeviceManager) flushRestart(cmdPieces []string) {
+	<-dm.watchStopped
+	dm.Lock()
+	pending := dm.drainRestarts()
+	dm.Unlock()
+	if pending {
+		slog.Info("Applying saved changes before stopping")
+		dm.restart(cmdPieces)
+	}
+	slog.Info("Stopping device manager")
+}
+
+// RestartStatus describes the last attempt to restart dhcpd.
+type RestartStatus struct {
+	Last     time.Time
+	Duration time.Duration
+	Error    string
+}
+
+// RestartStatus returns the result of the last dhcpd restart. Last is zero
+// if there has not been one yet.
+func (dm *DeviceManager) RestartStatus() RestartStatus {
+	dm.statusLock.Lock()
+	defer dm.statusLock.Unlock()
+	return dm.restartStatus
+}
+
+func (dm *DeviceManager) ConfigFile() string {
+	return dm.configFile
+}
+
+// LoadError returns why the config file could not be loaded, or nil if the
+// last load or reload parsed it.
+func (dm *DeviceManager) LoadError() error {
+	dm.RLock()
+	defer dm.RUnlock()
+	return dm.loadErr
+}
+
+// Stop stops watching the config file and waits for a pending dhcpd restart
+// to run, so that no saved change is left unapplied.
 func (dm *DeviceManager) Stop() {
-	dm.stopChan <- true
-	dm.watcher.Close()
+	close(dm.stopChan)
+	<-dm.stopped
 }
 
 func (dm *DeviceManager) Save() {
 	dm.Lock()
 	defer dm.Unlock()
-	dm.ignoreWrite = true
-	go func() { time.Sleep(time.Second); dm.ignoreWrite = false }()
-	log.Println("Saving device manager, writing config file.")
-	err := ioutil.WriteFile(dm.configFile, []byte(dm.String()), 0660)
+	err := dm.save()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Failed to save config file", "file", dm.configFile, "error", err)
+	}
+}
+
+// save writes the config file and schedules a dhcpd restart. The caller must
+// hold the lock.
+func (dm *DeviceManager) save() error {
+	if dm.loadErr != nil {
+		return fmt.Errorf("Refusing to write config file: %v", dm.loadErr)
+	}
+
+	// Never overwrite edits made to the file since netreg last read it
+	current, err := ioutil.ReadFile(dm.configFile)
+	if err == nil && sha256.Sum256(current) != dm.fileHash {
+		slog.Info("Config file was edited externally, merging before saving", "file", dm.configFile)
+		_, err = dm.merge(current)
+		if err != nil {
+			return err
+		}
 	}
+
+	slog.Debug("Writing config file", "file", dm.configFile, "devices", len(dm.devices))
+	data := []byte(dm.String())
+	err = ioutil.WriteFile(dm.configFile, data, 0660)
+	if err != nil {
+		return err
+	}
+	dm.remember(data)
 	dm.restartChan <- true
+	return nil
 }
 
+// clone returns an unstarted copy of the registry that can be changed
+// without affecting dm. Devices are shared, they are replaced rather than
+// modified in place. The caller must hold at least the read lock.
+func (dm *DeviceManager) clone() *DeviceManager {
+	c := &DeviceManager{
+		devices:    make(map[string]*Device, len(dm.devices)),
+		keys:       make([]sortableKey, len(dm.keys)),
+		configFile: dm.configFile,
+		layout:     dm.layout,
+		fileHead:   dm.fileHead,
+		fileTail:   dm.fileTail,
+		loadErr:    dm.loadErr,
+		revision:   dm.revision,
+		fileHash:   dm.fileHash,
+		base:       dm.base,
+		conflicts:  make(map[string]*Conflict, len(dm.conflicts)),
+	}
+	for mac, d := range dm.devices {
+		c.devices[mac] = d
+	}
+	copy(c.keys, dm.keys)
+	for mac, conflict := range dm.conflicts {
+		c.conflicts[mac] = conflict
+	}
+	return c
+}
+
+// Get, Set, Add, Remove, Contains and the List functions do not lock the
+// manager. Concurrent callers must use View or Update instead.
 func (dm *DeviceManager) Get(mac string) *Device {
 	return dm.devices[mac]
 }
@@ -222,6 +502,13 @@ func (dm *DeviceManager) Add(d *Device) {
 		return
 	}
 
+	dm.revision++
+	d.Version = dm.revision
+	dm.insert(d)
+}
+
+// insert adds d to the map and the sorted keys without touching versions.
+func (dm *DeviceManager) insert(d *Device) {
 	k := sortableKey{
 		Name:    d.Name,
 		MAC:     d.MAC,
@@ -233,6 +520,9 @@ func (dm *DeviceManager) Add(d *Device) {
 }
 
 func (dm *DeviceManager) Remove(mac string) {
+	if _, e := dm.devices[mac]; e {
+		dm.revision++
+	}
 	delete(dm.devices, mac)
 	for i, k := range dm.keys {
 		if k.MAC == mac {
@@ -269,6 +559,12 @@ func (dm *DeviceManager) Contains(mac string) bool {
 	return false
 }
 
+// Revision increases every time a device is added, changed or removed, or
+// the config file is reloaded.
+func (dm *DeviceManager) Revision() int64 {
+	return dm.revision
+}
+
 func (dm *DeviceManager) NumDevices() int {
 	return len(dm.devices)
 }
@@ -293,6 +589,6 @@ func (dm *DeviceManager) String() string {
 	}
 
 	// Write tail
-	result += "}\n"
+	result += dm.fileTail
 	return result
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -189,3 +190,201 @@ func TestListForUser(t *testing.T) {
 
 	// Ensure caller really owns all the returned devices.
 }
+
+const SAMPLE_INCLUDE = `# Hosts managed by netreg, included from dhcpd.conf
+   host ykim-laptop { hardware ethernet e0:ca:94:d4:4c:9f; }
+   host yli-eth { hardware ethernet 00:14:22:A6:22:44; }
+#  host dfindley-laptop { hardware ethernet 10:68:3f:fd:e9:1d; }
+`
+
+func TestIncludeFile(t *testing.T) {
+	// Create a known include file
+	ioutil.WriteFile("TestInclude.conf", []byte(SAMPLE_INCLUDE), 0664)
+
+	dm := NewIncludeDeviceManager("TestInclude.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.NumDevices() != 3 {
+		t.Fatal("File contained 3 devices, but dm loaded ", dm.NumDevices())
+	}
+
+	// Saving must not add the closing brace of the main config
+	dm.Save()
+	data, err := ioutil.ReadFile("TestInclude.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != SAMPLE_INCLUDE {
+		t.Fatal("Include file was not written back unchanged:\n", string(data))
+	}
+
+	dm2 := NewIncludeDeviceManager("TestInclude.conf")
+	err = dm2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm2.NumDevices() != 3 {
+		t.Fatal("Include file did not survive save and reload.")
+	}
+
+	os.Remove("TestInclude.conf")
+}
+
+const SAMPLE_MARKED = `subnet 129.15.11.0 netmask 255.255.255.0
+{
+   option routers 129.15.11.1;
+   # BEGIN NETREG
+   host ykim-laptop { hardware ethernet e0:ca:94:d4:4c:9f; }
+#  host dfindley-laptop { hardware ethernet 10:68:3f:fd:e9:1d; }
+   # END NETREG
+   host printer { hardware ethernet 00:11:22:33:44:55; }
+}
+
+subnet 10.0.0.0 netmask 255.255.255.0 { }
+`
+
+func TestMarkedSection(t *testing.T) {
+	ioutil.WriteFile("TestMarked.conf", []byte(SAMPLE_MARKED), 0664)
+
+	dm := NewMarkedDeviceManager("TestMarked.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hosts outside the markers are not managed
+	if dm.NumDevices() != 2 || dm.Contains("00:11:22:33:44:55") {
+		t.Fatal("Only the 2 devices between the markers should be loaded, got ", dm.NumDevices())
+	}
+
+	dm.Add(&Device{Name: "dfindley-iPhone", Owner: "dfindley", Device: "iPhone", MAC: "00:00:00:00:00:00", Enabled: true})
+	dm.Save()
+	data, _ := ioutil.ReadFile("TestMarked.conf")
+	expected := strings.Replace(SAMPLE_MARKED, "   # BEGIN NETREG\n", "   # BEGIN NETREG\n   host dfindley-iPhone { hardware ethernet 00:00:00:00:00:00; }\n", 1)
+	if string(data) != expected {
+		t.Fatal("Content outside the markers was not preserved:\n", string(data))
+	}
+
+	os.Remove("TestMarked.conf")
+}
+
+func TestMarkedSectionErrors(t *testing.T) {
+	broken := map[string]string{
+		"missing":   strings.Replace(SAMPLE_MARKED, "   # END NETREG\n", "", 1),
+		"duplicate": strings.Replace(SAMPLE_MARKED, "}\n\n", "}\n# BEGIN NETREG\n\n", 1),
+		"reversed":  "# END NETREG\n# BEGIN NETREG\n",
+	}
+	for name, conf := range broken {
+		ioutil.WriteFile("TestMarkedErrors.conf", []byte(conf), 0664)
+		dm := NewMarkedDeviceManager("TestMarkedErrors.conf")
+		err := dm.Load()
+		if err == nil {
+			t.Fatal("Loading a file with ", name, " markers should fail.")
+		}
+		if dm.LoadError() != err {
+			t.Fatal("LoadError should report why the file with ", name, " markers failed to load.")
+		}
+
+		// The broken file must be left alone
+		dm.Save()
+		data, _ := ioutil.ReadFile("TestMarkedErrors.conf")
+		if string(data) != conf {
+			t.Fatal("A file with ", name, " markers was overwritten.")
+		}
+	}
+	os.Remove("TestMarkedErrors.conf")
+}
+
+func TestVersions(t *testing.T) {
+	ioutil.WriteFile("TestVersions.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestVersions.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := dm.Revision()
+	laptop := dm.Get("e0:ca:94:d4:4c:9f")
+	phone := dm.Get("1c:99:4c:b5:af:9b")
+	if laptop.Version != rev || phone.Version != rev {
+		t.Fatal("Loaded devices should share the load revision.")
+	}
+
+	// Changing a device bumps its version and the registry revision
+	changed := *phone
+	changed.Enabled = false
+	dm.Set(&changed)
+	if dm.Revision() <= rev || dm.Get(phone.MAC).Version != dm.Revision() {
+		t.Fatal("Set did not assign a new version.")
+	}
+	if dm.Get(laptop.MAC).Version != rev {
+		t.Fatal("Set changed the version of an unrelated device.")
+	}
+	if dm.Get(phone.MAC).ETag() == laptop.ETag() {
+		t.Fatal("Different versions share an ETag.")
+	}
+
+	// Reloading the unchanged file keeps versions of untouched devices
+	changedVersion := dm.Get(phone.MAC).Version
+	err = dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.Get(laptop.MAC).Version != rev {
+		t.Fatal("Reload changed the version of an unchanged device.")
+	}
+	if dm.Get(phone.MAC).Version <= changedVersion {
+		t.Fatal("Reload should give a device that differs from the file a new version.")
+	}
+
+	os.Remove("TestVersions.conf")
+}
+
+func TestStopFlushesRestart(t *testing.T) {
+	ioutil.WriteFile("TestStop.conf", []byte(SAMPLE_CONF), 0664)
+	defer os.Remove("TestStop.conf")
+
+	dm := NewDeviceManager("TestStop.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarts := 0
+	dm.OnRestart = func(err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		restarts++
+	}
+	dm.Start("true")
+
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Remove("00:14:22:A6:22:44")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The save is well inside the one minute restart limit
+	dm.Stop()
+	if restarts != 1 {
+		t.Fatal("Stop should run the pending restart once, ran", restarts)
+	}
+	if s := dm.RestartStatus(); s.Last.IsZero() {
+		t.Fatal("Restart status was not recorded.")
+	}
+
+	// Stopping with nothing saved must not restart dhcpd
+	dm = NewDeviceManager("TestStop.conf")
+	err = dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.OnRestart = func(err error) {
+		t.Fatal("Restarted dhcpd with no changes to apply.")
+	}
+	dm.Start("true")
+	dm.Stop()
+}
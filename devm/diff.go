@@ -0,0 +1,152 @@
+package devm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Number of unchanged lines shown around each change in a unified diff.
+const diffContext = 3
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// UnifiedDiff returns the unified diff turning a into b, or "" if they are
+// equal.
+func UnifiedDiff(fromName, toName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	// Position in a and b before each line of the diff
+	aPos := make([]int, len(lines)+1)
+	bPos := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if l.op != '+' {
+			aPos[i+1]++
+		}
+		if l.op != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	result := fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName)
+	i := 0
+	for i < len(lines) {
+		// Find the next change
+		for i < len(lines) && lines[i].op == ' ' {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		end := i + 1
+		for j := end; j < len(lines) && j <= end+2*diffContext; j++ {
+			if lines[j].op != ' ' {
+				end = j + 1
+			}
+		}
+		i = end
+		end += diffContext
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		result += fmt.Sprintf("@@ -%s +%s @@\n",
+			hunkRange(aPos[start], aPos[end]-aPos[start]),
+			hunkRange(bPos[start], bPos[end]-bPos[start]))
+		for _, l := range lines[start:end] {
+			result += string(l.op) + l.text
+		}
+	}
+	return result
+}
+
+func hunkRange(pos, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", pos)
+	}
+	return fmt.Sprintf("%d,%d", pos+1, count)
+}
+
+// splitLines splits s into lines, each ending in a newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n"
+	}
+	return lines
+}
+
+// diffLines computes a line diff from the longest common subsequence of a and
+// b. Common leading and trailing lines are stripped first, so the quadratic
+// table only covers the region that actually changed.
+func diffLines(a, b []string) []diffLine {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	am := a[pre : len(a)-suf]
+	bm := b[pre : len(b)-suf]
+
+	lcs := make([][]int, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	result := make([]diffLine, 0, len(a)+len(b))
+	for _, l := range a[:pre] {
+		result = append(result, diffLine{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(am) && j < len(bm) {
+		if am[i] == bm[j] {
+			result = append(result, diffLine{' ', am[i]})
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			result = append(result, diffLine{'-', am[i]})
+			i++
+		} else {
+			result = append(result, diffLine{'+', bm[j]})
+			j++
+		}
+	}
+	for ; i < len(am); i++ {
+		result = append(result, diffLine{'-', am[i]})
+	}
+	for ; j < len(bm); j++ {
+		result = append(result, diffLine{'+', bm[j]})
+	}
+	for _, l := range a[len(a)-suf:] {
+		result = append(result, diffLine{' ', l})
+	}
+	return result
+}
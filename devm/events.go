@@ -0,0 +1,110 @@
+package devm
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_ADDED     = "added"
+	EVENT_UPDATED   = "updated"
+	EVENT_REMOVED   = "removed"
+	EVENT_RELOADED  = "reloaded"
+	EVENT_RESTARTED = "restarted"
+)
+
+// Event describes a change to the registry. Device is the device after the
+// change, or before it for EVENT_REMOVED; Previous is only set for
+// EVENT_UPDATED. Reloads and restarts carry no device.
+type Event struct {
+	Type     string
+	Device   *Device `json:",omitempty"`
+	Previous *Device `json:",omitempty"`
+	Revision int64
+	Time     time.Time
+	Error    string `json:",omitempty"`
+	// How long a dhcpd restart took
+	Duration time.Duration `json:",omitempty"`
+}
+
+// Owner returns the owner of the device the event is about, or "" for
+// events that are not about a single device.
+func (e *Event) Owner() string {
+	if e.Device != nil {
+		return e.Device.Owner
+	}
+	return ""
+}
+
+// How many events a subscriber may fall behind before events are dropped
+// for it.
+const subscriberBuffer = 64
+
+type publisher struct {
+	subs map[chan Event]bool
+	sync.Mutex
+}
+
+// Subscribe returns a channel receiving every event from now on, and a
+// function that unsubscribes and closes the channel. Events are dropped for
+// subscribers that do not keep up rather than blocking the registry.
+func (dm *DeviceManager) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	dm.events.Lock()
+	if dm.events.subs == nil {
+		dm.events.subs = make(map[chan Event]bool)
+	}
+	dm.events.subs[ch] = true
+	dm.events.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			dm.events.Lock()
+			delete(dm.events.subs, ch)
+			dm.events.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (dm *DeviceManager) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	dm.events.Lock()
+	defer dm.events.Unlock()
+	for ch := range dm.events.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishChanges publishes an event for every device that differs between
+// before and the registry, and passes them all to OnChange. The caller must
+// hold the lock.
+func (dm *DeviceManager) publishChanges(before map[string]*Device) {
+	now := time.Now()
+	events := make([]Event, 0)
+	for mac, old := range before {
+		d := dm.devices[mac]
+		if d == nil {
+			events = append(events, Event{Type: EVENT_REMOVED, Device: old, Revision: dm.revision, Time: now})
+		} else if d != old {
+			events = append(events, Event{Type: EVENT_UPDATED, Device: d, Previous: old, Revision: dm.revision, Time: now})
+		}
+	}
+	for mac, d := range dm.devices {
+		if before[mac] == nil {
+			events = append(events, Event{Type: EVENT_ADDED, Device: d, Revision: dm.revision, Time: now})
+		}
+	}
+	for _, e := range events {
+		dm.publish(e)
+	}
+	if dm.OnChange != nil && len(events) > 0 {
+		dm.OnChange(events)
+	}
+}
@@ -0,0 +1,105 @@
+package devm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	ioutil.WriteFile("TestEvents.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestEvents.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := dm.Subscribe()
+
+	newDev := &Device{Name: "dfindley-iPhone", Owner: "dfindley", Device: "iPhone", MAC: "00:00:00:00:00:00", Enabled: true}
+	dm.Update(func(tx *Tx) error { return tx.Add(newDev) })
+	e := <-events
+	if e.Type != EVENT_ADDED || e.Device != newDev || e.Owner() != "dfindley" {
+		t.Fatal("Expected an added event for the new device, got ", e)
+	}
+
+	changed := *newDev
+	changed.Enabled = false
+	dm.Update(func(tx *Tx) error { return tx.Set(&changed) })
+	e = <-events
+	if e.Type != EVENT_UPDATED || e.Device != &changed || e.Previous != newDev {
+		t.Fatal("Expected an updated event with the previous state, got ", e)
+	}
+
+	dm.Update(func(tx *Tx) error { return tx.Remove(changed.MAC) })
+	e = <-events
+	if e.Type != EVENT_REMOVED || e.Device != &changed || e.Revision != dm.Revision() {
+		t.Fatal("Expected a removed event, got ", e)
+	}
+
+	// Failed and read-only transactions publish nothing
+	dm.Update(func(tx *Tx) error { return tx.Remove("no:such:mac") })
+	dm.View(func(tx *Tx) error { return nil })
+	select {
+	case e = <-events:
+		t.Fatal("Unexpected event ", e)
+	default:
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Fatal("Unsubscribing should close the channel.")
+	}
+	unsubscribe()
+
+	os.Remove("TestEvents.conf")
+}
+
+func TestOnChange(t *testing.T) {
+	ioutil.WriteFile("TestOnChange.conf", []byte(SAMPLE_CONF), 0664)
+	defer os.Remove("TestOnChange.conf")
+
+	dm := NewDeviceManager("TestOnChange.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []Event
+	dm.OnChange = func(events []Event) {
+		changes = append(changes, events...)
+	}
+
+	// Every event reaches OnChange, however many there are
+	err = dm.Update(func(tx *Tx) error {
+		for i := 0; i < 2*subscriberBuffer; i++ {
+			mac := fmt.Sprintf("00:00:00:00:%02X:%02X", i/256, i%256)
+			name := fmt.Sprint("dev", i)
+			err := tx.Add(&Device{Name: "dfindley-" + name, Owner: "dfindley", Device: name, MAC: mac, Enabled: true})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2*subscriberBuffer {
+		t.Fatal("Expected an event per added device, got ", len(changes))
+	}
+
+	// So do changes made by editing the file
+	changes = nil
+	data, _ := ioutil.ReadFile("TestOnChange.conf")
+	edited := strings.Replace(string(data), "   host yli-eth", "#  host yli-eth", 1)
+	ioutil.WriteFile("TestOnChange.conf", []byte(edited), 0664)
+	err = dm.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != EVENT_UPDATED || changes[0].Device.Enabled {
+		t.Fatal("Expected the edit to be reported as an update, got ", changes)
+	}
+}
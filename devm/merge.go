@@ -0,0 +1,249 @@
+package devm
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+var ERR_NO_CONFLICT = errors.New("No conflict exists for this MAC address")
+
+// Conflict is a device that was changed both through netreg and by an
+// external edit of the config file since netreg last read it. Ours stays in
+// effect until an admin resolves the conflict. A nil side means the device
+// was removed (or not yet added) on that side.
+type Conflict struct {
+	MAC        string
+	Base       *Device
+	Ours       *Device
+	Theirs     *Device
+	DetectedAt time.Time
+}
+
+// Reload merges external edits of the config file into the registry and
+// writes back anything that only exists in memory. It does nothing if the
+// file is unchanged since netreg last loaded or saved it, so the watcher can
+// call it on every event, including those caused by netreg's own writes.
+func (dm *DeviceManager) Reload() error {
+	dm.Lock()
+	defer dm.Unlock()
+	data, err := ioutil.ReadFile(dm.configFile)
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(data) == dm.fileHash {
+		return nil
+	}
+	slog.Info("Detected config file edit", "file", dm.configFile)
+	before := dm.devices
+	unsaved, err := dm.merge(data)
+	if err != nil {
+		return err
+	}
+	dm.publish(Event{Type: EVENT_RELOADED, Revision: dm.revision})
+	dm.publishChanges(before)
+	if unsaved {
+		return dm.save()
+	}
+	return nil
+}
+
+// merge performs a three-way merge of host records between the last known
+// file (base), the registry (ours) and data (theirs). Everything outside the
+// host records is taken from data. Afterwards data is the new base. It
+// reports whether the merged registry has changes that are not in data. The
+// caller must hold the lock.
+func (dm *DeviceManager) merge(data []byte) (bool, error) {
+	theirs := &DeviceManager{
+		devices:    make(map[string]*Device),
+		keys:       make([]sortableKey, 0),
+		configFile: dm.configFile,
+		layout:     dm.layout,
+		fileTail:   dm.fileTail,
+	}
+	err := theirs.parse(data)
+	if err != nil {
+		// Same as a failed Load, don't write until the file is fixed
+		dm.loadErr = err
+		return false, err
+	}
+	dm.loadErr = nil
+
+	ours := dm.devices
+	macs := make(map[string]bool)
+	for _, m := range []map[string]*Device{dm.base, ours, theirs.devices} {
+		for mac := range m {
+			macs[mac] = true
+		}
+	}
+
+	merged := make(map[string]*Device)
+	unsaved := false
+	for mac := range macs {
+		b, o, t := dm.base[mac], ours[mac], theirs.devices[mac]
+		keep := o
+		switch {
+		case sameDevice(o, t):
+		case sameDevice(o, b):
+			// Only the file changed
+			keep = t
+		case sameDevice(t, b):
+			// Only netreg changed
+		default:
+			slog.Warn("Conflicting changes in netreg and the config file", "mac", mac)
+			dm.conflicts[mac] = &Conflict{
+				MAC:        mac,
+				Base:       b,
+				Ours:       o,
+				Theirs:     t,
+				DetectedAt: time.Now(),
+			}
+		}
+		if keep != nil {
+			merged[mac] = keep
+		}
+		if !sameDevice(keep, t) {
+			unsaved = true
+		}
+	}
+
+	dm.devices = make(map[string]*Device)
+	dm.keys = make([]sortableKey, 0)
+	for _, d := range merged {
+		dm.insert(d)
+	}
+	dm.renumber(ours)
+	dm.fileHead = theirs.fileHead
+	dm.fileTail = theirs.fileTail
+	dm.remember(data)
+	dm.base = theirs.devices
+	dm.settleConflicts()
+	dm.saveConflicts()
+	return unsaved, nil
+}
+
+// settleConflicts drops the conflicts where the registry has come to agree
+// with their side, and reports whether there were any. The caller must
+// hold the lock.
+func (dm *DeviceManager) settleConflicts() bool {
+	settled := false
+	for mac, c := range dm.conflicts {
+		if sameDevice(dm.devices[mac], c.Theirs) {
+			delete(dm.conflicts, mac)
+			settled = true
+		}
+	}
+	return settled
+}
+
+// loadConflicts reads the conflicts file, dropping conflicts the loaded
+// file has since settled. The caller must hold the lock.
+func (dm *DeviceManager) loadConflicts() error {
+	dm.conflicts = make(map[string]*Conflict)
+	if dm.ConflictsFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(dm.ConflictsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Conflict
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	for _, c := range list {
+		dm.conflicts[c.MAC] = c
+	}
+	if dm.settleConflicts() {
+		dm.saveConflicts()
+	}
+	return nil
+}
+
+// saveConflicts writes the conflicts file. The caller must hold the lock.
+func (dm *DeviceManager) saveConflicts() {
+	if dm.ConflictsFile == "" {
+		return
+	}
+	list := make([]*Conflict, 0, len(dm.conflicts))
+	for _, c := range dm.conflicts {
+		list = append(list, c)
+	}
+	sort.Sort(byMAC(list))
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode conflicts", "error", err)
+		return
+	}
+	err = ioutil.WriteFile(dm.ConflictsFile, data, 0660)
+	if err != nil {
+		slog.Error("Failed to write conflicts", "file", dm.ConflictsFile, "error", err)
+	}
+}
+
+// sameDevice compares two possibly missing devices, ignoring versions.
+func sameDevice(a, b *Device) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.sameAs(b)
+}
+
+// Conflicts returns the unresolved merge conflicts, ordered by MAC.
+func (dm *DeviceManager) Conflicts() []*Conflict {
+	dm.RLock()
+	defer dm.RUnlock()
+	result := make([]*Conflict, 0, len(dm.conflicts))
+	for _, c := range dm.conflicts {
+		result = append(result, c)
+	}
+	sort.Sort(byMAC(result))
+	return result
+}
+
+// ResolveConflict settles the conflict for mac, either leaving netreg's
+// version in effect or replacing it with the one from the file.
+func (dm *DeviceManager) ResolveConflict(mac string, keepTheirs bool) error {
+	err := dm.Update(func(tx *Tx) error {
+		c := tx.dm.conflicts[mac]
+		if c == nil {
+			return ERR_NO_CONFLICT
+		}
+		delete(tx.dm.conflicts, mac)
+		if !keepTheirs {
+			return nil
+		}
+		if tx.Contains(mac) {
+			tx.Remove(mac)
+		}
+		if c.Theirs != nil {
+			d := *c.Theirs
+			return tx.Add(&d)
+		}
+		// Removing the device still needs a save
+		tx.changed = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dm.Lock()
+	dm.saveConflicts()
+	dm.Unlock()
+	return nil
+}
+
+type byMAC []*Conflict
+
+func (a byMAC) Len() int           { return len(a) }
+func (a byMAC) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMAC) Less(i, j int) bool { return a[i].MAC < a[j].MAC }
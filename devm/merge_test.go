@@ -0,0 +1,165 @@
+package devm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMergeExternalEdit(t *testing.T) {
+	ioutil.WriteFile("TestMerge.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestMerge.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading our own file does nothing
+	rev := dm.Revision()
+	err = dm.Reload()
+	if err != nil || dm.Revision() != rev {
+		t.Fatal("Reloading an unchanged file should be a no-op.")
+	}
+
+	// Someone disables a device by hand and adds another
+	edited := strings.Replace(SAMPLE_CONF, "   host yli-eth", "#  host yli-eth", 1)
+	edited = strings.Replace(edited, "#  host kblee-roku3wifi", "   host kblee-printer { hardware ethernet 00:11:22:33:44:55; }\n#  host kblee-roku3wifi", 1)
+	ioutil.WriteFile("TestMerge.conf", []byte(edited), 0664)
+
+	// Before the watcher notices, netreg adds a device
+	newDev := &Device{Name: "dfindley-iPhone", Owner: "dfindley", Device: "iPhone", MAC: "00:00:00:00:00:00", Enabled: true}
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Add(newDev)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both sides survive
+	data, _ := ioutil.ReadFile("TestMerge.conf")
+	for _, line := range []string{
+		"   host dfindley-iPhone { hardware ethernet 00:00:00:00:00:00; }",
+		"#  host yli-eth { hardware ethernet 00:14:22:A6:22:44; }",
+		"   host kblee-printer { hardware ethernet 00:11:22:33:44:55; }",
+	} {
+		if !strings.Contains(string(data), line) {
+			t.Fatal("Merged file is missing '", line, "':\n", string(data))
+		}
+	}
+	if dm.Get("00:14:22:A6:22:44").Enabled || !dm.Contains("00:11:22:33:44:55") {
+		t.Fatal("The external edit was not merged into the registry.")
+	}
+	if len(dm.Conflicts()) != 0 {
+		t.Fatal("Independent changes should not conflict.")
+	}
+
+	os.Remove("TestMerge.conf")
+}
+
+func TestMergeConflict(t *testing.T) {
+	ioutil.WriteFile("TestConflict.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestConflict.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same device is disabled by hand and renamed through netreg
+	edited := strings.Replace(SAMPLE_CONF, "   host ykim-phone", "#  host ykim-phone", 1)
+	ioutil.WriteFile("TestConflict.conf", []byte(edited), 0664)
+	renamed := &Device{Name: "ykim-iphone", Owner: "ykim", Device: "iphone", MAC: "1c:99:4c:b5:af:9b", Enabled: true}
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Set(renamed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts := dm.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].MAC != renamed.MAC {
+		t.Fatal("Expected a single conflict for the changed device.")
+	}
+	c := conflicts[0]
+	if c.Ours == nil || c.Ours.Device != "iphone" || c.Theirs == nil || c.Theirs.Enabled || c.Base == nil || !c.Base.Enabled {
+		t.Fatal("Conflict does not hold both sides and the base.")
+	}
+
+	// Ours stays in effect until resolved
+	if dm.Get(renamed.MAC).Device != "iphone" {
+		t.Fatal("netreg's change should stay in effect while unresolved.")
+	}
+
+	err = dm.ResolveConflict(renamed.MAC, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := dm.Get(renamed.MAC); d.Device != "phone" || d.Enabled {
+		t.Fatal("Resolving with theirs did not apply the file's version.")
+	}
+	if len(dm.Conflicts()) != 0 {
+		t.Fatal("Resolved conflict is still listed.")
+	}
+	if dm.ResolveConflict(renamed.MAC, true) != ERR_NO_CONFLICT {
+		t.Fatal("Resolving twice should fail.")
+	}
+
+	os.Remove("TestConflict.conf")
+}
+
+func TestConflictsSurviveRestart(t *testing.T) {
+	ioutil.WriteFile("TestConflicts.conf", []byte(SAMPLE_CONF), 0664)
+	os.Remove("TestConflicts.json")
+	defer os.Remove("TestConflicts.conf")
+	defer os.Remove("TestConflicts.json")
+
+	dm := NewDeviceManager("TestConflicts.conf")
+	dm.ConflictsFile = "TestConflicts.json"
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(SAMPLE_CONF, "   host ykim-phone", "#  host ykim-phone", 1)
+	ioutil.WriteFile("TestConflicts.conf", []byte(edited), 0664)
+	renamed := &Device{Name: "ykim-iphone", Owner: "ykim", Device: "iphone", MAC: "1c:99:4c:b5:af:9b", Enabled: true}
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Set(renamed)
+	})
+	if err != nil || len(dm.Conflicts()) != 1 {
+		t.Fatal("Expected a conflict, got ", err)
+	}
+
+	// The hand edit is not in the file any more, but is not lost either
+	dm = NewDeviceManager("TestConflicts.conf")
+	dm.ConflictsFile = "TestConflicts.json"
+	err = dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts := dm.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Theirs == nil || conflicts[0].Theirs.Enabled {
+		t.Fatal("The conflict did not survive a restart.")
+	}
+
+	// Unrelated edits leave it alone
+	data, _ := ioutil.ReadFile("TestConflicts.conf")
+	ioutil.WriteFile("TestConflicts.conf", []byte(strings.Replace(string(data), "   host yli-eth", "#  host yli-eth", 1)), 0664)
+	err = dm.Reload()
+	if err != nil || len(dm.Conflicts()) != 1 {
+		t.Fatal("An unrelated edit settled the conflict: ", err)
+	}
+
+	// The device is changed through netreg to match the hand edit
+	phone := *conflicts[0].Theirs
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Set(&phone)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.Conflicts()) != 0 {
+		t.Fatal("A conflict whose sides agree is still listed.")
+	}
+}
@@ -0,0 +1,192 @@
+package devm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TrashedDevice is a removed device kept around so it can be restored.
+type TrashedDevice struct {
+	Device    *Device
+	DeletedAt time.Time
+	DeletedBy string
+}
+
+// Trash holds removed devices, keyed by MAC, until they are restored or the
+// retention window passes. It is persisted as JSON so that deletions survive
+// restarts.
+type Trash struct {
+	entries   map[string]*TrashedDevice
+	file      string
+	retention time.Duration
+	stopChan  chan bool
+	sync.Mutex
+}
+
+func NewTrash(file string, retention time.Duration) *Trash {
+	return &Trash{
+		entries:   make(map[string]*TrashedDevice),
+		file:      file,
+		retention: retention,
+		stopChan:  make(chan bool),
+	}
+}
+
+// Load reads the trash file. A missing file is an empty trash.
+func (t *Trash) Load() error {
+	t.Lock()
+	defer t.Unlock()
+	t.entries = make(map[string]*TrashedDevice)
+	data, err := ioutil.ReadFile(t.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*TrashedDevice
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	for _, td := range list {
+		t.entries[td.Device.MAC] = td
+	}
+	return nil
+}
+
+// Start purges expired entries periodically until Stop is called.
+func (t *Trash) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			t.Purge()
+			select {
+			case <-ticker.C:
+			case <-t.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (t *Trash) Stop() {
+	t.stopChan <- true
+}
+
+// Put moves d into the trash, replacing any older entry with the same MAC.
+func (t *Trash) Put(d *Device, deletedBy string) {
+	t.Lock()
+	defer t.Unlock()
+	t.entries[d.MAC] = &TrashedDevice{
+		Device:    d,
+		DeletedAt: time.Now(),
+		DeletedBy: deletedBy,
+	}
+	t.save()
+}
+
+func (t *Trash) Get(mac string) *TrashedDevice {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[mac]
+}
+
+// Take removes and returns the entry for mac, or nil if there is none.
+func (t *Trash) Take(mac string) *TrashedDevice {
+	t.Lock()
+	defer t.Unlock()
+	td := t.entries[mac]
+	if td == nil {
+		return nil
+	}
+	delete(t.entries, mac)
+	t.save()
+	return td
+}
+
+// Discard removes td from the trash if it is still the entry for its MAC,
+// and reports whether it was. A newer deletion of the same MAC is kept.
+func (t *Trash) Discard(td *TrashedDevice) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.entries[td.Device.MAC] != td {
+		return false
+	}
+	delete(t.entries, td.Device.MAC)
+	t.save()
+	return true
+}
+
+// Purge drops entries older than the retention window and returns how many
+// were removed.
+func (t *Trash) Purge() int {
+	t.Lock()
+	defer t.Unlock()
+	cutoff := time.Now().Add(-t.retention)
+	purged := 0
+	for mac, td := range t.entries {
+		if td.DeletedAt.Before(cutoff) {
+			delete(t.entries, mac)
+			purged++
+		}
+	}
+	if purged > 0 {
+		slog.Info("Purged devices from the trash", "count", purged)
+		t.save()
+	}
+	return purged
+}
+
+// ListForUser returns the trashed devices owned by owner, newest first.
+func (t *Trash) ListForUser(owner string) []*TrashedDevice {
+	return t.list(func(td *TrashedDevice) bool { return td.Device.Owner == owner })
+}
+
+// ListAll returns every trashed device, newest first.
+func (t *Trash) ListAll() []*TrashedDevice {
+	return t.list(func(td *TrashedDevice) bool { return true })
+}
+
+func (t *Trash) list(keep func(*TrashedDevice) bool) []*TrashedDevice {
+	t.Lock()
+	defer t.Unlock()
+	result := make([]*TrashedDevice, 0)
+	for _, td := range t.entries {
+		if keep(td) {
+			result = append(result, td)
+		}
+	}
+	sort.Sort(byDeletedAt(result))
+	return result
+}
+
+// save writes the trash file. The caller must hold the lock.
+func (t *Trash) save() {
+	list := make([]*TrashedDevice, 0, len(t.entries))
+	for _, td := range t.entries {
+		list = append(list, td)
+	}
+	sort.Sort(byDeletedAt(list))
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode trash", "error", err)
+		return
+	}
+	err = ioutil.WriteFile(t.file, data, 0660)
+	if err != nil {
+		slog.Error("Failed to write trash", "file", t.file, "error", err)
+	}
+}
+
+type byDeletedAt []*TrashedDevice
+
+func (a byDeletedAt) Len() int           { return len(a) }
+func (a byDeletedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDeletedAt) Less(i, j int) bool { return a[i].DeletedAt.After(a[j].DeletedAt) }
@@ -0,0 +1,59 @@
+package devm
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	os.Remove("TestTrash.json")
+	trash := NewTrash("TestTrash.json", time.Hour)
+	if err := trash.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	laptop := &Device{Name: "dfindley-laptop", Owner: "dfindley", Device: "laptop", MAC: "10:68:3f:fd:e9:1d", Enabled: true}
+	phone := &Device{Name: "ykim-phone", Owner: "ykim", Device: "phone", MAC: "1c:99:4c:b5:af:9b", Enabled: true}
+	trash.Put(laptop, "dfindley")
+	trash.Put(phone, "dfindley")
+
+	if len(trash.ListAll()) != 2 {
+		t.Fatal("Trash should contain 2 devices.")
+	}
+	if len(trash.ListForUser("ykim")) != 1 {
+		t.Fatal("Trash should contain 1 device owned by ykim.")
+	}
+
+	// Reload from disk
+	trash2 := NewTrash("TestTrash.json", time.Hour)
+	if err := trash2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	td := trash2.Take(laptop.MAC)
+	if td == nil || *td.Device != *laptop || td.DeletedBy != "dfindley" {
+		t.Fatal("Trashed device did not survive save and reload.")
+	}
+	if trash2.Get(laptop.MAC) != nil {
+		t.Fatal("Restored device is still in the trash.")
+	}
+
+	// Discarding a restored entry leaves a newer deletion alone
+	old := trash2.Get(phone.MAC)
+	trash2.Put(phone, "ykim")
+	if trash2.Discard(old) || trash2.Get(phone.MAC) == nil {
+		t.Fatal("Discard removed a newer entry.")
+	}
+	if !trash2.Discard(trash2.Get(phone.MAC)) || trash2.Get(phone.MAC) != nil {
+		t.Fatal("Discard did not remove the entry.")
+	}
+	trash2.Put(phone, "ykim")
+
+	// Expire the remaining entry
+	trash2.entries[phone.MAC].DeletedAt = time.Now().Add(-2 * time.Hour)
+	if trash2.Purge() != 1 || len(trash2.ListAll()) != 0 {
+		t.Fatal("Expired device was not purged.")
+	}
+
+	os.Remove("TestTrash.json")
+}
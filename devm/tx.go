@@ -0,0 +1,148 @@
+package devm
+
+import (
+	"errors"
+)
+
+var (
+	ERR_DEVICE_EXISTS = errors.New("A device with this MAC address already exists")
+	ERR_NO_DEVICE     = errors.New("No device with this MAC address exists")
+	ERR_READ_ONLY     = errors.New("Cannot change devices in a read-only transaction")
+)
+
+// Tx gives a function passed to View, Update or DryRun access to the
+// registry while the manager is locked. It must not be kept after the
+// function returns.
+type Tx struct {
+	dm       *DeviceManager
+	writable bool
+	changed  bool
+}
+
+// View calls fn with a read-only transaction.
+func (dm *DeviceManager) View(fn func(tx *Tx) error) error {
+	dm.RLock()
+	defer dm.RUnlock()
+	return fn(&Tx{dm: dm})
+}
+
+// Update calls fn with a writable transaction while holding the lock. If fn
+// returns an error, every change it made is rolled back. Otherwise, if
+// anything changed, the config file is written and a dhcpd restart is
+// scheduled before the lock is released; a failed write is rolled back too.
+func (dm *DeviceManager) Update(fn func(tx *Tx) error) error {
+	dm.Lock()
+	defer dm.Unlock()
+	backup := dm.clone()
+	tx := &Tx{dm: dm, writable: true}
+	err := fn(tx)
+	if err == nil && tx.changed {
+		err = dm.save()
+	}
+	if err == nil && tx.changed {
+		if dm.settleConflicts() {
+			dm.saveConflicts()
+		}
+		dm.publishChanges(backup.devices)
+	}
+	if err != nil {
+		// A merge while saving may have found conflicts that are now undone
+		conflictsChanged := len(dm.conflicts) != len(backup.conflicts)
+		for mac, c := range dm.conflicts {
+			if backup.conflicts[mac] != c {
+				conflictsChanged = true
+			}
+		}
+		dm.devices = backup.devices
+		dm.keys = backup.keys
+		dm.revision = backup.revision
+		dm.fileHead = backup.fileHead
+		dm.fileTail = backup.fileTail
+		dm.fileHash = backup.fileHash
+		dm.base = backup.base
+		dm.conflicts = backup.conflicts
+		if conflictsChanged {
+			dm.saveConflicts()
+		}
+		return err
+	}
+	return nil
+}
+
+// DryRun calls fn like Update, but against a copy of the registry. It returns
+// the unified diff between the current config and the one Update would have
+// written. Nothing is saved and no restart is scheduled.
+func (dm *DeviceManager) DryRun(fn func(tx *Tx) error) (string, error) {
+	dm.RLock()
+	c := dm.clone()
+	current := dm.String()
+	dm.RUnlock()
+
+	err := fn(&Tx{dm: c, writable: true})
+	if err != nil {
+		return "", err
+	}
+	return UnifiedDiff(dm.configFile, dm.configFile+" (candidate)", current, c.String()), nil
+}
+
+func (tx *Tx) Get(mac string) *Device {
+	return tx.dm.Get(mac)
+}
+
+func (tx *Tx) Contains(mac string) bool {
+	return tx.dm.Contains(mac)
+}
+
+func (tx *Tx) ListForUser(owner string) []*Device {
+	return tx.dm.ListForUser(owner)
+}
+
+func (tx *Tx) ListAll() []*Device {
+	return tx.dm.ListAll()
+}
+
+func (tx *Tx) NumDevices() int {
+	return tx.dm.NumDevices()
+}
+
+func (tx *Tx) Revision() int64 {
+	return tx.dm.Revision()
+}
+
+// Add adds a new device, failing if its MAC is already registered.
+func (tx *Tx) Add(d *Device) error {
+	if !tx.writable {
+		return ERR_READ_ONLY
+	}
+	if tx.dm.Contains(d.MAC) {
+		return ERR_DEVICE_EXISTS
+	}
+	tx.dm.Add(d)
+	tx.changed = true
+	return nil
+}
+
+// Set replaces the device with the same MAC.
+func (tx *Tx) Set(d *Device) error {
+	if !tx.writable {
+		return ERR_READ_ONLY
+	}
+	if !tx.dm.Contains(d.MAC) {
+		return ERR_NO_DEVICE
+	}
+	tx.dm.Set(d)
+	tx.changed = true
+	return nil
+}
+
+func (tx *Tx) Remove(mac string) error {
+	if !tx.writable {
+		return ERR_READ_ONLY
+	}
+	if !tx.dm.Contains(mac) {
+		return ERR_NO_DEVICE
+	}
+	tx.dm.Remove(mac)
+	tx.changed = true
+	return nil
+}
@@ -0,0 +1,145 @@
+package devm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	ioutil.WriteFile("TestUpdate.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestUpdate.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preSize := dm.NumDevices()
+
+	// A successful update is saved
+	newDev := &Device{Name: "dfindley-iPhone", Owner: "dfindley", Device: "iPhone", MAC: "00:00:00:00:00:00", Enabled: true}
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Add(newDev)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile("TestUpdate.conf")
+	if !strings.Contains(string(data), "dfindley-iPhone") {
+		t.Fatal("Update did not save the config file.")
+	}
+
+	// A failed update changes nothing
+	rev := dm.Revision()
+	abort := errors.New("abort")
+	err = dm.Update(func(tx *Tx) error {
+		tx.Remove("00:14:A5:89:AC:63")
+		tx.Remove(newDev.MAC)
+		return abort
+	})
+	if err != abort {
+		t.Fatal("Update did not return the error from its function.")
+	}
+	if dm.NumDevices() != preSize+1 || len(dm.keys) != preSize+1 || dm.Revision() != rev {
+		t.Fatal("A failed update was not rolled back.")
+	}
+	if !dm.Contains("00:14:A5:89:AC:63") || !dm.Contains(newDev.MAC) {
+		t.Fatal("Devices removed in a failed update are missing.")
+	}
+
+	// Adding an existing MAC fails
+	err = dm.Update(func(tx *Tx) error {
+		return tx.Add(&Device{Name: "x-y", Owner: "x", Device: "y", MAC: newDev.MAC})
+	})
+	if err != ERR_DEVICE_EXISTS {
+		t.Fatal("Adding a duplicate MAC should fail with ERR_DEVICE_EXISTS.")
+	}
+
+	// View is read-only
+	err = dm.View(func(tx *Tx) error {
+		return tx.Remove(newDev.MAC)
+	})
+	if err != ERR_READ_ONLY || !dm.Contains(newDev.MAC) {
+		t.Fatal("View allowed a change.")
+	}
+
+	os.Remove("TestUpdate.conf")
+}
+
+func TestDryRun(t *testing.T) {
+	ioutil.WriteFile("TestDryRun.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestDryRun.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := dm.String()
+	diff, err := dm.DryRun(func(tx *Tx) error {
+		tx.Remove("00:14:A5:89:AC:63")
+		return tx.Add(&Device{Name: "dfindley-iPhone", Owner: "dfindley", Device: "iPhone", MAC: "00:00:00:00:00:00", Enabled: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "\n-   host yli-wi { hardware ethernet 00:14:A5:89:AC:63; }\n") {
+		t.Fatal("Dry run diff does not show the removed device:\n", diff)
+	}
+	if !strings.Contains(diff, "\n+   host dfindley-iPhone { hardware ethernet 00:00:00:00:00:00; }\n") {
+		t.Fatal("Dry run diff does not show the added device:\n", diff)
+	}
+	if strings.Count(diff, "@@ -") != 1 {
+		t.Fatal("Nearby changes should share a single hunk:\n", diff)
+	}
+	if dm.String() != before || !dm.Contains("00:14:A5:89:AC:63") || dm.Contains("00:00:00:00:00:00") {
+		t.Fatal("Dry run changed the device manager.")
+	}
+	if diff, _ := dm.DryRun(func(tx *Tx) error { return nil }); diff != "" {
+		t.Fatal("Dry run without changes should produce an empty diff.")
+	}
+	data, _ := ioutil.ReadFile("TestDryRun.conf")
+	if string(data) != SAMPLE_CONF {
+		t.Fatal("Dry run wrote the config file.")
+	}
+
+	os.Remove("TestDryRun.conf")
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	ioutil.WriteFile("TestConcurrent.conf", []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager("TestConcurrent.conf")
+	err := dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preSize := dm.NumDevices()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mac := fmt.Sprintf("02:00:00:00:00:%02x", i)
+			dm.Update(func(tx *Tx) error {
+				return tx.Add(&Device{Name: "test-dev", Owner: "test", Device: "dev", MAC: mac, Enabled: true})
+			})
+			dm.View(func(tx *Tx) error {
+				tx.ListAll()
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	if dm.NumDevices() != preSize+50 || len(dm.keys) != preSize+50 {
+		t.Fatal("Concurrent updates lost devices.")
+	}
+
+	os.Remove("TestConcurrent.conf")
+}
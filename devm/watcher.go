@@ -0,0 +1,111 @@
+package devm
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+// How long the watcher lets a burst of events settle before reloading.
+// Editors and config management tools often write, rename and chmod a file
+// in quick succession.
+const watchDebounce = 250 * time.Millisecond
+
+// WatcherStatus describes the health of the config file watcher.
+type WatcherStatus struct {
+	Running    bool
+	Dir        string
+	LastEvent  time.Time
+	LastReload time.Time
+	Reloads    int
+	LastError  string
+}
+
+func (dm *DeviceManager) WatcherStatus() WatcherStatus {
+	dm.statusLock.Lock()
+	defer dm.statusLock.Unlock()
+	return dm.watchStatus
+}
+
+func (dm *DeviceManager) updateWatchStatus(update func(s *WatcherStatus)) {
+	dm.statusLock.Lock()
+	defer dm.statusLock.Unlock()
+	update(&dm.watchStatus)
+}
+
+// watch reloads the config file whenever it changes until Stop is called.
+// It watches the containing directory rather than the file, so the watch
+// survives the file being replaced by a rename or briefly disappearing.
+func (dm *DeviceManager) watch() {
+	dir := filepath.Dir(dm.configFile)
+	name := filepath.Base(dm.configFile)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Could not create file watcher", "error", err)
+		dm.updateWatchStatus(func(s *WatcherStatus) { s.LastError = err.Error() })
+		return
+	}
+	defer watcher.Close()
+	err = watcher.Add(dir)
+	if err != nil {
+		slog.Error("Could not start watching config directory", "dir", dir, "error", err)
+		dm.updateWatchStatus(func(s *WatcherStatus) { s.LastError = err.Error() })
+		return
+	}
+	dm.updateWatchStatus(func(s *WatcherStatus) {
+		s.Running = true
+		s.Dir = dir
+	})
+	defer dm.updateWatchStatus(func(s *WatcherStatus) { s.Running = false })
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != name {
+				continue
+			}
+			slog.Debug("Watcher event", "file", event.Name, "op", event.Op.String())
+			dm.updateWatchStatus(func(s *WatcherStatus) { s.LastEvent = time.Now() })
+			settled = time.After(watchDebounce)
+		case <-settled:
+			settled = nil
+			err := dm.Reload()
+			if os.IsNotExist(err) {
+				// Part way through a replace, the next Create will bring it back
+				slog.Warn("Config file is missing, waiting for it to reappear", "file", dm.configFile)
+			} else if err != nil {
+				slog.Error("Failed to reload config file", "file", dm.configFile, "error", err)
+			}
+			dm.updateWatchStatus(func(s *WatcherStatus) {
+				if err != nil {
+					s.LastError = err.Error()
+					return
+				}
+				s.LastReload = time.Now()
+				s.Reloads++
+				s.LastError = ""
+			})
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Watcher error", "error", err)
+			dm.updateWatchStatus(func(s *WatcherStatus) { s.LastError = err.Error() })
+		case <-dm.stopChan:
+			if settled != nil {
+				// Pick up the last external edit before stopping
+				if err := dm.Reload(); err != nil {
+					slog.Error("Failed to reload config file", "file", dm.configFile, "error", err)
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package devm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcherRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netreg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confFile := filepath.Join(dir, "dhcpd.conf")
+	ioutil.WriteFile(confFile, []byte(SAMPLE_CONF), 0664)
+
+	dm := NewDeviceManager(confFile)
+	err = dm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.Start("true")
+	defer dm.Stop()
+
+	// Wait for the watcher to come up
+	for i := 0; i < 100 && !dm.WatcherStatus().Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !dm.WatcherStatus().Running {
+		t.Fatal("Watcher did not start: ", dm.WatcherStatus().LastError)
+	}
+
+	// Replace the file the way vim and ansible do
+	edited := strings.Replace(SAMPLE_CONF, "   host yli-eth", "#  host yli-eth", 1)
+	tmpFile := filepath.Join(dir, ".dhcpd.conf.tmp")
+	ioutil.WriteFile(tmpFile, []byte(edited), 0664)
+	os.Rename(tmpFile, confFile)
+	os.Chmod(confFile, 0660)
+
+	reloaded := false
+	for i := 0; i < 200 && !reloaded; i++ {
+		time.Sleep(10 * time.Millisecond)
+		dm.View(func(tx *Tx) error {
+			reloaded = !tx.Get("00:14:22:A6:22:44").Enabled
+			return nil
+		})
+	}
+	if !reloaded {
+		t.Fatal("Renamed config file was not reloaded.")
+	}
+	if s := dm.WatcherStatus(); s.Reloads != 1 || s.LastError != "" {
+		t.Fatal("A burst of events should cause a single reload: ", s)
+	}
+}
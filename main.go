@@ -1,27 +1,49 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-ldap/ldap"
 	"github.com/gorilla/mux"
 
+	"github.com/tortis/netreg/audit"
+	"github.com/tortis/netreg/certs"
+	"github.com/tortis/netreg/config"
 	"github.com/tortis/netreg/devm"
+	"github.com/tortis/netreg/metrics"
+	"github.com/tortis/netreg/session"
 	"github.com/tortis/netreg/token"
+	"github.com/tortis/netreg/webhook"
 )
 
 var ldapSearchPath string
 var webPort int
 var ldapServer string
 var ldapPort int
+var ldapTimeout time.Duration
 var dhcpdConfigFile string
+var dhcpdIncludeFile string
+var dhcpdMarkers bool
 var dhcpdRestartCmd string
 var hostHTML bool
 var enableCORS bool
@@ -29,48 +51,304 @@ var htmlDir string
 var adminUser string
 var pubKey string
 var privKey string
+var auditLogFile string
+var trashFile string
+var conflictsFile string
+var trashRetention time.Duration
+var webhookURLs string
+var webhookSecret string
+var webhookQueueFile string
+var logLevel string
+var logFormat string
+var configFile string
+var corsOrigins string
+var deviceQuota int
+var shutdownTimeout time.Duration
+var listenAddr string
+var useTLS bool
+var tlsMinVersion string
+var tlsCiphers string
+var trustedProxyList string
+var tokenIssuer string
+var tokenAudience string
+var clientCA string
+var clientCertIdentity string
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Forwarded-Proto
+// headers are believed.
+var trustedProxies []*net.IPNet
+
+// listenUnix is set when serving on a Unix socket. Only local processes can
+// connect to one, so the peer is always treated as a trusted proxy.
+var listenUnix bool
+
+// commandLine holds the flags given on the command line, which take
+// precedence over the config file and environment.
+var commandLine = make(map[string]bool)
+
+// reloadable lists the settings that take effect on SIGHUP. Everything else
+// needs a restart.
+var reloadable = []string{"adminuser", "cors-origins", "log-level", "device-quota"}
+
+// settings holds the reloadable settings in parsed form.
+type settings struct {
+	admins      map[string]bool
+	corsOrigins []string
+	deviceQuota int
+	logLevel    slog.Level
+}
+
+var current atomic.Pointer[settings]
+var logLevelVar = new(slog.LevelVar)
+
+var metricsRegistry = metrics.NewRegistry()
+var (
+	requestsTotal        = metricsRegistry.NewCounter("netreg_http_requests_total", "API requests by route, method and status.", "route", "method", "status")
+	requestDuration      = metricsRegistry.NewHistogram("netreg_http_request_duration_seconds", "API request latency by route and method.", metrics.DefBuckets, "route", "method")
+	loginsTotal          = metricsRegistry.NewCounter("netreg_logins_total", "Login attempts by result: success, failure, or error when LDAP is unreachable.", "result")
+	ldapDuration         = metricsRegistry.NewHistogram("netreg_ldap_duration_seconds", "Time to connect and bind to the LDAP server.", metrics.DefBuckets)
+	dhcpdRestarts        = metricsRegistry.NewCounter("netreg_dhcpd_restarts_total", "dhcpd restarts.")
+	dhcpdRestartFailures = metricsRegistry.NewCounter("netreg_dhcpd_restart_failures_total", "dhcpd restarts whose command failed.")
+	dhcpdRestartDuration = metricsRegistry.NewHistogram("netreg_dhcpd_restart_duration_seconds", "Time taken by the dhcpd restart command.", []float64{.1, .5, 1, 2.5, 5, 10, 30, 60})
+	configReloads        = metricsRegistry.NewCounter("netreg_config_reloads_total", "Reloads of the config file after external edits.")
+)
 
 var deviceManager *devm.DeviceManager
-var key []byte
+var sessions *session.Store
+var auditLog *audit.Log
+var trash *devm.Trash
+var webhooks *webhook.Dispatcher
+var tokenKeyFile string
+var tokenKeysFile string
+var tokenKeyAlg string
+var tokenKeyRotation time.Duration
+var tokenKeyRetain time.Duration
+
+// Login tokens are signed with keys from the keyring, unless a token-key
+// file is given, in which case staticKey signs them all.
+var keyring *token.Keyring
+var staticKey *token.Key
+var accessTokenExp string
+var refreshTokenExp string
+var sessionsFile string
+
+// Lifetimes of access tokens and of sessions kept alive by refresh tokens,
+// in seconds.
+var accessExp int64
+var refreshExp int64
+
+// shuttingDown is closed when the server starts to shut down, to end
+// requests that would otherwise stay open indefinitely.
+var shuttingDown = make(chan struct{})
 
 func init() {
 	flag.IntVar(&webPort, "web-port", 3000, "port that the web server will listen on.")
+	flag.StringVar(&listenAddr, "listen", "", "Address to listen on instead of web-port, e.g. 127.0.0.1:3000 or unix:/run/netreg/netreg.sock")
+	flag.BoolVar(&useTLS, "tls", true, "If false, serve plain HTTP, for running behind a reverse proxy that terminates TLS.")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Oldest TLS version to accept: 1.0, 1.1, 1.2 or 1.3.")
+	flag.StringVar(&tlsCiphers, "tls-ciphers", "", "Comma separated TLS 1.2 cipher suites to allow. Empty uses Go's defaults.")
+	flag.StringVar(&tokenKeyFile, "token-key", "", "PEM private key (RSA, P-256 or Ed25519) to sign all login tokens with, instead of the rotating keys in token-keys.")
+	flag.StringVar(&tokenKeysFile, "token-keys", "token-keys.json", "Path to the file holding the keys login tokens are signed with. It is created on first run.")
+	flag.StringVar(&tokenKeyAlg, "token-key-alg", token.ALG_EDDSA, "Algorithm of generated token keys: HS256, RS256, ES256 or EdDSA.")
+	flag.DurationVar(&tokenKeyRotation, "token-key-rotation", 30*24*time.Hour, "How often to replace the token signing key. 0 never rotates.")
+	flag.DurationVar(&tokenKeyRetain, "token-key-retain", 7*24*time.Hour, "How long tokens signed by a replaced key stay valid. Should exceed the token lifetime.")
+	flag.StringVar(&accessTokenExp, "access-token-exp", "1hour", "Lifetime of access tokens: 1hour, 6hour, 12hour, 1day, 2day, 3day, 1week, 2week, 3week, 4week or never.")
+	flag.StringVar(&refreshTokenExp, "refresh-token-exp", "2week", "How long a session lasts after its last refresh, from the same choices as access-token-exp.")
+	flag.StringVar(&sessionsFile, "sessions", "sessions.json", "Path to the file holding login sessions and their refresh token secrets.")
+	flag.StringVar(&tokenIssuer, "token-issuer", "netreg", "Issuer (iss) put in and required of login tokens.")
+	flag.StringVar(&tokenAudience, "token-audience", "netreg", "Audience (aud) put in and required of login tokens.")
+	flag.StringVar(&clientCA, "client-ca", "", "PEM file of CAs whose client certificates are accepted in place of a login token.")
+	flag.StringVar(&clientCertIdentity, "client-cert-identity", certs.IDENTITY_CN, "Client certificate field naming the user: cn, email (the part before @) or dns.")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "Comma separated IPs or CIDRs of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted.")
 	flag.StringVar(&ldapServer, "ldap-server", "localhost", "LDAP server to connect to.")
 	flag.IntVar(&ldapPort, "ldap-port", 389, "Port to connect to LDAP server on.")
+	flag.DurationVar(&ldapTimeout, "ldap-timeout", 2*time.Second, "How long the readiness check waits for the LDAP server.")
 	flag.StringVar(&ldapSearchPath, "ldap-search-path", "uid=%s,ou=people,dc=math,dc=nor,dc=ou,dc=edu", "Format string for ldap bind DN")
 	flag.StringVar(&dhcpdConfigFile, "dhcpd-conf-file", "/etc/dhcp/dhcpd.conf", "dhcpd config file to use.")
+	flag.StringVar(&dhcpdIncludeFile, "dhcpd-include-file", "", "If set, only this file of host declarations is managed. It must be included from dhcpd-conf-file.")
+	flag.BoolVar(&dhcpdMarkers, "dhcpd-markers", false, "If set, only the hosts between '# BEGIN NETREG' and '# END NETREG' in dhcpd-conf-file are managed.")
 	flag.StringVar(&dhcpdRestartCmd, "dhcpd-restart", "/sbin/service dhcpd restart", "command to restart the dhcp server.")
 	flag.StringVar(&htmlDir, "htmldir", "./public", "Path to the HTML directory")
-	flag.StringVar(&adminUser, "adminuser", "dfindley", "Username that will receive admin privs.")
+	flag.StringVar(&configFile, "config", "", "Path to a TOML config file. Settings use the flag names, and NETREG_* environment variables override them.")
+	flag.StringVar(&adminUser, "adminuser", "dfindley", "Comma separated usernames that will receive admin privs.")
 	flag.BoolVar(&hostHTML, "hosthtml", false, "If set, the the server will also host static html from 'htmldir'")
 	flag.BoolVar(&enableCORS, "enablecors", true, "If set, the server will send cross-origin headers.")
+	flag.StringVar(&corsOrigins, "cors-origins", "*", "Comma separated origins allowed to make cross-origin requests.")
+	flag.IntVar(&deviceQuota, "device-quota", 0, "Most devices a non-admin user may register. 0 means no limit.")
 	flag.StringVar(&pubKey, "publickey", "public_key.pem", "Path to the public key file.")
 	flag.StringVar(&privKey, "privatekey", "private_key.pem", "Path to the private key file")
-
-	// Generate a random token key
-	key = make([]byte, 16)
-	rand.Read(key)
+	flag.StringVar(&auditLogFile, "audit-log", "audit.log", "Path to the append-only audit log.")
+	flag.StringVar(&trashFile, "trash-file", "trash.json", "Path to the file holding deleted devices.")
+	flag.StringVar(&conflictsFile, "conflicts-file", "conflicts.json", "Path to the file holding unresolved conflicts between netreg and edits of the dhcpd config.")
+	flag.StringVar(&webhookURLs, "webhooks", "", "Comma separated URLs that receive device change events.")
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "Shared secret used to sign webhook payloads.")
+	flag.StringVar(&webhookQueueFile, "webhook-queue", "webhooks.json", "Path to the file holding the webhook delivery queue.")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level to log: debug, info, warn or error.")
+	flag.StringVar(&logFormat, "log-format", "text", "Log output format: text or json.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests in progress when shutting down.")
+	flag.DurationVar(&trashRetention, "trash-retention", 30*24*time.Hour, "How long deleted devices can be restored.")
 }
 
 func main() {
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	values, err := readConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := values.Apply(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	s, err := newSettings(func(name string) string {
+		return flag.Lookup(name).Value.String()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	current.Store(s)
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnHangup()
+
+	// Open the audit log
+	auditLog, err = audit.Open(auditLogFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	// Load the keys login tokens are signed with
+	accessExp, err = token.ParseExp(accessTokenExp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refreshExp, err = token.ParseExp(refreshTokenExp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessions = session.NewStore(sessionsFile)
+	err = sessions.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessions.Start()
+	defer sessions.Stop()
+	if tokenKeyFile != "" {
+		staticKey, err = token.LoadKey(tokenKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !staticKey.CanSign() {
+			log.Fatalf("token-key %s is a public key, netreg needs the private key to sign tokens", tokenKeyFile)
+		}
+	} else {
+		switch tokenKeyAlg {
+		case token.ALG_HS256, token.ALG_RS256, token.ALG_ES256, token.ALG_EDDSA:
+		default:
+			log.Fatalf("Unknown token-key-alg %q", tokenKeyAlg)
+		}
+		keyring = token.NewKeyring(tokenKeysFile, tokenKeyAlg, tokenKeyRetain)
+		err = keyring.Load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyring.Start(tokenKeyRotation)
+		defer keyring.Stop()
+	}
+
 	// Start the config file manager (device manager)
-	deviceManager = devm.NewDeviceManager(dhcpdConfigFile)
-	err := deviceManager.Load()
+	switch {
+	case dhcpdIncludeFile != "" && dhcpdMarkers:
+		log.Fatal("Only one of -dhcpd-include-file and -dhcpd-markers may be set.")
+	case dhcpdIncludeFile != "":
+		checkInclude(dhcpdConfigFile, dhcpdIncludeFile)
+		deviceManager = devm.NewIncludeDeviceManager(dhcpdIncludeFile)
+	case dhcpdMarkers:
+		deviceManager = devm.NewMarkedDeviceManager(dhcpdConfigFile)
+	default:
+		deviceManager = devm.NewDeviceManager(dhcpdConfigFile)
+	}
+	deviceManager.ConflictsFile = conflictsFile
+	err = deviceManager.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Loaded devices", "count", deviceManager.NumDevices(), "file", deviceManager.ConfigFile())
+	deviceManager.OnRestart = func(err error) {
+		e := audit.Event{Actor: "netreg", Action: audit.ACTION_RESTART}
+		if err != nil {
+			e.Detail = err.Error()
+		}
+		if err := auditLog.Record(e); err != nil {
+			slog.Error("Failed to write audit event", "error", err)
+		}
+	}
+
+	// Queue webhooks for every device change before anything can change
+	var targets []string
+	if webhookURLs != "" {
+		targets = strings.Split(webhookURLs, ",")
+		if webhookSecret == "" {
+			log.Fatal("webhook-secret must be set when webhooks are, or deliveries cannot be verified.")
+		}
+	}
+	webhooks = webhook.NewDispatcher(webhookQueueFile, targets, []byte(webhookSecret))
+	err = webhooks.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Loaded ", deviceManager.NumDevices(), " devices.")
+	webhooks.Start()
+	defer webhooks.Stop()
+	deviceManager.OnChange = queueWebhooks
 	deviceManager.Start(dhcpdRestartCmd)
-	defer deviceManager.Stop()
+
+	// Load the trash of deleted devices
+	trash = devm.NewTrash(trashFile, trashRetention)
+	err = trash.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	trash.Start()
+	defer trash.Stop()
+
+	// Collect metrics
+	registerDeviceMetrics()
+	metricEvents, unsubscribeMetrics := deviceManager.Subscribe()
+	defer unsubscribeMetrics()
+	go collectMetrics(metricEvents)
 
 	// Create the routing mux
 	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/metrics", serveMetrics).Methods("GET")
+	router.HandleFunc("/healthz", healthz).Methods("GET")
+	router.HandleFunc("/readyz", readyz).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", serveJWKS).Methods("GET")
+	router.HandleFunc("/token-keys/rotate", rotateTokenKey).Methods("POST")
 	router.HandleFunc("/login", loginHandler).Methods("POST")
+	router.HandleFunc("/token/refresh", refreshToken).Methods("POST")
+	router.HandleFunc("/logout", logoutHandler).Methods("POST")
+	router.HandleFunc("/users/{username}/revoke", revokeUser).Methods("POST")
+	router.HandleFunc("/sessions", listSessions).Methods("GET")
+	router.HandleFunc("/sessions/{id}", endSession).Methods("DELETE")
 	router.HandleFunc("/devices", listDevices).Methods("GET")
+	router.HandleFunc("/devices/export", exportDevices).Methods("GET")
+	router.HandleFunc("/devices/{did}", getDevice).Methods("GET")
 	router.HandleFunc("/devices/{did}", removeDevice).Methods("DELETE")
 	router.HandleFunc("/devices", addDevice).Methods("POST")
 	router.HandleFunc("/devices/{did}", updateDevice).Methods("PUT")
+	router.HandleFunc("/trash", listTrash).Methods("GET")
+	router.HandleFunc("/trash/{did}/restore", restoreDevice).Methods("POST")
+	router.HandleFunc("/audit", listAudit).Methods("GET")
+	router.HandleFunc("/conflicts", listConflicts).Methods("GET")
+	router.HandleFunc("/status", showStatus).Methods("GET")
+	router.HandleFunc("/events", streamEvents).Methods("GET")
+	router.HandleFunc("/webhooks", listWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/retry", retryWebhook).Methods("POST")
+	router.HandleFunc("/conflicts/{did}/resolve", resolveConflict).Methods("POST")
 
 	// Server HTML
 	if hostHTML {
@@ -78,85 +356,1187 @@ func main() {
 	}
 
 	// Add middleware for CORS
+	var handler http.Handler = router
 	if enableCORS {
-		http.Handle("/", corsMiddleware(router))
+		handler = corsMiddleware(handler)
+	}
+	http.Handle("/", loggingMiddleware(handler))
+
+	trustedProxies, err = parseProxies(trustedProxyList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{}
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+	if clientCA != "" && !useTLS {
+		log.Fatal("client-ca needs tls, client certificates cannot be checked behind a proxy.")
+	}
+	if useTLS {
+		server.TLSConfig, err = tlsConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener = tls.NewListener(listener, server.TLSConfig)
+	}
+	go func() {
+		slog.Info("Serving requests", "address", listener.Addr().String(), "tls", useTLS)
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Run until asked to stop, then let requests in progress finish before
+	// applying any saved changes that dhcpd has not picked up yet.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Gave up waiting for requests to finish", "error", err)
+	}
+	deviceManager.Stop()
+	slog.Info("Stopped")
+}
+
+// readConfig gathers the settings from the config file and environment,
+// leaving out those given on the command line.
+func readConfig() (config.Values, error) {
+	values := make(config.Values)
+	if configFile != "" {
+		var err error
+		values, err = config.Read(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	values.Merge(config.Environ(os.Environ()))
+	delete(values, "config")
+	for name := range commandLine {
+		delete(values, name)
+	}
+	return values, values.Check(flag.CommandLine)
+}
+
+// newSettings parses the reloadable settings, looking up their text with get.
+func newSettings(get func(name string) string) (*settings, error) {
+	s := &settings{admins: make(map[string]bool)}
+	for _, admin := range strings.Split(get("adminuser"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			s.admins[admin] = true
+		}
+	}
+	for _, origin := range strings.Split(get("cors-origins"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			s.corsOrigins = append(s.corsOrigins, origin)
+		}
+	}
+	quota, err := strconv.Atoi(get("device-quota"))
+	if err != nil || quota < 0 {
+		return nil, fmt.Errorf("invalid device-quota %q", get("device-quota"))
+	}
+	s.deviceQuota = quota
+	if err := s.logLevel.UnmarshalText([]byte(get("log-level"))); err != nil {
+		return nil, fmt.Errorf("invalid log-level %q", get("log-level"))
+	}
+	return s, nil
+}
+
+// reloadConfig re-reads the config file and environment and applies the
+// reloadable settings. Nothing changes if any of them is invalid.
+func reloadConfig() error {
+	values, err := readConfig()
+	if err != nil {
+		return err
+	}
+	s, err := newSettings(func(name string) string {
+		if value, ok := values[name]; ok {
+			return value
+		}
+		f := flag.Lookup(name)
+		if commandLine[name] {
+			return f.Value.String()
+		}
+		return f.DefValue
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range reloadable {
+		delete(values, name)
+	}
+	for _, name := range values.Changed(flag.CommandLine) {
+		slog.Warn("Setting change needs a restart to take effect", "setting", name)
+	}
+	current.Store(s)
+	logLevelVar.Set(s.logLevel)
+	return nil
+}
+
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("Failed to reload configuration", "error", err)
+			continue
+		}
+		slog.Info("Reloaded configuration", "file", configFile)
+	}
+}
+
+// setupLogging installs the default logger according to the log-level and
+// log-format settings. Packages using the standard log package go through it
+// too.
+func setupLogging() error {
+	logLevelVar.Set(current.Load().logLevel)
+	opts := &slog.HandlerOptions{Level: logLevelVar}
+	var h slog.Handler
+	switch logFormat {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q", logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// listen opens the listener given by the listen setting, falling back to
+// web-port on all interfaces.
+func listen() (net.Listener, error) {
+	if strings.HasPrefix(listenAddr, "unix:") {
+		path := strings.TrimPrefix(listenAddr, "unix:")
+		// Clear out a socket left behind by an unclean exit
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// Let the proxy's group connect
+		if err := os.Chmod(path, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+		listenUnix = true
+		return l, nil
+	}
+	addr := listenAddr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", webPort)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// tlsConfig builds the TLS settings, serving a certificate that is reloaded
+// when the files change on disk.
+func tlsConfig() (*tls.Config, error) {
+	minVersion, err := certs.ParseVersion(tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := certs.ParseCiphers(tlsCiphers)
+	if err != nil {
+		return nil, err
+	}
+	reloader := certs.NewReloader(pubKey, privKey)
+	if err := reloader.Load(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	// Let automation authenticate with a client certificate. Browsers
+	// without one still log in as usual.
+	if clientCA != "" {
+		if err := certs.CheckIdentity(clientCertIdentity); err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs, err = certs.LoadPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	reloader.Start()
+	return cfg, nil
+}
+
+// parseProxies reads a comma separated list of IPs and CIDRs.
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkInclude warns if the main dhcpd config does not include the managed
+// host file, since changes to it would then never reach dhcpd.
+func checkInclude(configFile, includeFile string) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		slog.Warn("Could not check that the config includes the host file", "config", configFile, "include", includeFile, "error", err)
+		return
+	}
+	statement := regexp.MustCompile(`(?m)^\s*include\s+"` + regexp.QuoteMeta(includeFile) + `"\s*;`)
+	if !statement.Match(data) {
+		slog.Warn("Config does not include the managed host file", "config", configFile, "include", includeFile)
+	}
+}
+
+func corsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		for _, allowed := range current.Load().corsOrigins {
+			if allowed == "*" {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				break
+			}
+			if allowed == origin {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				break
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps event streams working through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is filled in as a request passes through the middleware and
+// handlers, and logged once the response is written.
+type requestInfo struct {
+	id    string
+	user  string
+	route string
+}
+
+// loggingMiddleware assigns each request an ID, echoed in the X-Request-ID
+// header, and logs a summary line when the request completes. An ID sent by
+// the client or a proxy is kept so requests can be traced across services.
+func loggingMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if info.id == "" || len(info.id) > 64 {
+			info.id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", info.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		level := slog.LevelInfo
+		if sw.status >= 500 {
+			level = slog.LevelError
+		}
+		requestLog(r).Log(r.Context(), level, "Handled request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", info.route,
+			"status", sw.status,
+			"scheme", requestScheme(r),
+			"duration", time.Since(start),
+			"client_ip", clientIP(r))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLog returns a logger carrying the request ID and, once the token has
+// been validated, the user making the request.
+func requestLog(r *http.Request) *slog.Logger {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return slog.Default()
+	}
+	l := slog.With("request_id", info.id)
+	if info.user != "" {
+		l = l.With("user", info.user)
+	}
+	return l
+}
+
+// setRequestUser records who is making the request for later log lines.
+func setRequestUser(r *http.Request, username string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.user = username
+	}
+}
+
+// metricsMiddleware counts and times requests by their route template, so
+// device MACs don't end up as label values.
+func metricsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.route = route
+		}
+		requestsTotal.Inc(route, r.Method, strconv.Itoa(sw.status))
+		requestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsRegistry.Write(w)
+}
+
+// registerDeviceMetrics adds gauges computed from the registry at scrape
+// time.
+func registerDeviceMetrics() {
+	metricsRegistry.NewGaugeFunc("netreg_devices", "Registered devices by state.", func() []metrics.Sample {
+		enabled, disabled := 0, 0
+		deviceManager.View(func(tx *devm.Tx) error {
+			for _, d := range tx.ListAll() {
+				if d.Enabled {
+					enabled++
+				} else {
+					disabled++
+				}
+			}
+			return nil
+		})
+		return []metrics.Sample{
+			{Labels: []string{"total"}, Value: float64(enabled + disabled)},
+			{Labels: []string{"enabled"}, Value: float64(enabled)},
+			{Labels: []string{"disabled"}, Value: float64(disabled)},
+		}
+	}, "state")
+
+	// Owners are bucketed by how many devices they have, rather than one
+	// series per user.
+	buckets := []struct {
+		label    string
+		min, max int
+	}{{"1", 1, 1}, {"2-5", 2, 5}, {"6-10", 6, 10}, {"11+", 11, 1 << 30}}
+	metricsRegistry.NewGaugeFunc("netreg_owners", "Device owners by number of registered devices.", func() []metrics.Sample {
+		perOwner := make(map[string]int)
+		deviceManager.View(func(tx *devm.Tx) error {
+			for _, d := range tx.ListAll() {
+				perOwner[d.Owner]++
+			}
+			return nil
+		})
+		samples := make([]metrics.Sample, len(buckets))
+		for i, b := range buckets {
+			samples[i].Labels = []string{b.label}
+			for _, n := range perOwner {
+				if n >= b.min && n <= b.max {
+					samples[i].Value++
+				}
+			}
+		}
+		return samples
+	}, "devices")
+}
+
+// collectMetrics counts dhcpd restarts and config reloads.
+func collectMetrics(events <-chan devm.Event) {
+	for e := range events {
+		switch e.Type {
+		case devm.EVENT_RESTARTED:
+			dhcpdRestarts.Inc()
+			if e.Error != "" {
+				dhcpdRestartFailures.Inc()
+			}
+			dhcpdRestartDuration.Observe(e.Duration.Seconds())
+		case devm.EVENT_RELOADED:
+			configReloads.Inc()
+		}
+	}
+}
+
+// tokenKeys returns the key to sign new tokens with, and all the keys that
+// tokens may have been signed with.
+func tokenKeys() (*token.Key, []*token.Key) {
+	if staticKey != nil {
+		return staticKey, []*token.Key{staticKey}
+	}
+	return keyring.SigningKey(), keyring.Keys()
+}
+
+// serveJWKS publishes the public keys that login tokens are signed with, so
+// other services can check them. It is empty when tokens use HMAC secrets.
+func serveJWKS(w http.ResponseWriter, r *http.Request) {
+	set := token.JWKSet{Keys: []token.JWK{}}
+	if staticKey != nil {
+		if jwk, ok := staticKey.PublicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
 	} else {
-		http.Handle("/", router)
+		set = keyring.JWKS()
+	}
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	err := encoder.Encode(set)
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// rotateTokenKey replaces the token signing key ahead of schedule. Tokens
+// signed with the old key stay valid for token-key-retain.
+func rotateTokenKey(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	if t.Contents["admin"] != "yes" {
+		http.Error(w, "Only admins can rotate token keys.", http.StatusForbidden)
+		return
+	}
+	if staticKey != nil {
+		http.Error(w, "Tokens are signed with the token-key file, replace it to rotate.", http.StatusConflict)
+		return
+	}
+
+	err := keyring.Rotate()
+	if err != nil {
+		requestLog(r).Error("Failed to rotate token key", "error", err)
+		http.Error(w, "Server failed to rotate the token key.", http.StatusInternalServerError)
+		return
+	}
+	kid := keyring.SigningKey().ID()
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	err = encoder.Encode(map[string]string{"kid": kid})
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Rotated token key", "kid", kid)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_ROTATE_KEY, Detail: "kid " + kid})
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// readinessCheck is the result of one of the checks made by readyz.
+type readinessCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newCheck(err error) readinessCheck {
+	if err != nil {
+		return readinessCheck{Error: err.Error()}
+	}
+	return readinessCheck{OK: true}
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]readinessCheck)
+
+	// Config file is readable and was parsed
+	configErr := deviceManager.LoadError()
+	if configErr == nil {
+		var f *os.File
+		f, configErr = os.Open(deviceManager.ConfigFile())
+		if configErr == nil {
+			f.Close()
+		}
+	}
+	checks["config"] = newCheck(configErr)
+
+	// Watcher is running
+	var watcherErr error
+	if ws := deviceManager.WatcherStatus(); !ws.Running {
+		watcherErr = fmt.Errorf("config watcher is not running: %s", ws.LastError)
+	}
+	checks["watcher"] = newCheck(watcherErr)
+
+	// The last dhcpd restart, if any, succeeded
+	var restartErr error
+	if rs := deviceManager.RestartStatus(); rs.Error != "" {
+		restartErr = fmt.Errorf("last restart at %s failed: %s", rs.Last.Format(time.RFC3339), rs.Error)
+	}
+	checks["dhcpd"] = newCheck(restartErr)
+
+	// LDAP server is reachable
+	conn, ldapErr := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ldapServer, ldapPort), ldapTimeout)
+	if ldapErr == nil {
+		conn.Close()
+	}
+	checks["ldap"] = newCheck(ldapErr)
+
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":  status == http.StatusOK,
+		"checks": checks,
+	})
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	// Start the ldap connection
+	var ldapConn *ldap.Conn
+	var err error
+	ldapStart := time.Now()
+	ldapConn, err = ldap.Dial("tcp", fmt.Sprintf("%s:%d", ldapServer, ldapPort))
+	if err != nil {
+		// Outages are what these metrics are most needed for
+		ldapDuration.Observe(time.Since(ldapStart).Seconds())
+		loginsTotal.Inc("error")
+		requestLog(r).Error("Failed to connect to LDAP server", "error", err)
+		http.Error(w, "Could not connect to LDAP database", http.StatusInternalServerError)
+		return
+	}
+	defer ldapConn.Close()
+
+	// Get the username and password.
+	username := r.FormValue("un")
+	password := r.FormValue("pw")
+
+	// Attempt LDAP bind
+	ldapUser := fmt.Sprintf(ldapSearchPath, username)
+	lde := ldapConn.Bind(ldapUser, password)
+	ldapDuration.Observe(time.Since(ldapStart).Seconds())
+	if lde != nil {
+		loginsTotal.Inc("failure")
+		http.Error(w, "Incorrect username or password", http.StatusBadRequest)
+		requestLog(r).Info("Login failed", "username", username)
+		recordAudit(r, audit.Event{Actor: username, Action: audit.ACTION_LOGIN_FAILED})
+		return
+	}
+
+	// Start a session and create JWT
+	refresh, sess, err := sessions.Create(username, clientIP(r), r.UserAgent(), expDuration(refreshExp))
+	if err != nil {
+		requestLog(r).Error("Failed to start session", "username", username, "error", err)
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	res, err := newAccessToken(username, sess.ID)
+	if err != nil {
+		requestLog(r).Error("Failed to generate token", "username", username, "error", err)
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// Clients that predate refresh tokens expect the bare access token
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeTokens(w, res, refresh)
+	} else {
+		w.Write(res)
+	}
+	loginsTotal.Inc("success")
+	setRequestUser(r, username)
+	requestLog(r).Info("Login succeeded")
+	recordAudit(r, audit.Event{Actor: username, Action: audit.ACTION_LOGIN})
+}
+
+// newAccessToken signs a short lived token for username in session sid.
+// Whether the user is an admin is decided afresh every time.
+func newAccessToken(username, sid string) ([]byte, error) {
+	t := token.NewToken(accessExp)
+	t.Subject = username
+	t.Issuer = tokenIssuer
+	t.Audience = token.Audience{tokenAudience}
+	t.Contents["username"] = username
+	t.Contents["sid"] = sid
+	if current.Load().admins[username] {
+		t.Contents["admin"] = "yes"
+	}
+	signing, _ := tokenKeys()
+	return t.SignWith(signing)
+}
+
+// tokenResponse is the body returned from /login to clients that accept
+// JSON, and from /token/refresh.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func writeTokens(w http.ResponseWriter, access []byte, refresh string) {
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := encoder.Encode(tokenResponse{
+		AccessToken:  string(access),
+		TokenType:    "Bearer",
+		ExpiresIn:    accessExp,
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// expDuration converts an EXP_* lifetime to a duration, with 0 for
+// EXP_NEVER.
+func expDuration(exp int64) time.Duration {
+	if exp == token.EXP_NEVER {
+		return 0
+	}
+	return time.Duration(exp) * time.Second
+}
+
+// refreshToken exchanges a refresh token for a new access token and refresh
+// token, extending the session.
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil {
+		http.Error(w, "Unable to parse request.", http.StatusBadRequest)
+		return
+	}
+
+	refresh, sess, err := sessions.Refresh(body.RefreshToken, expDuration(refreshExp))
+	switch err {
+	case nil:
+	case session.ERR_REFRESH_REUSED:
+		// Someone has a copy of the token, so the whole session was ended
+		setRequestUser(r, sess.Username)
+		requestLog(r).Warn("Refresh token reused, ended session", "session", sess.ID)
+		recordAudit(r, audit.Event{Actor: sess.Username, Action: audit.ACTION_TOKEN_REUSE, Detail: "session " + sess.ID})
+		http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		return
+	case session.ERR_EXPIRED:
+		http.Error(w, "Session is expired", http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		return
+	}
+	setRequestUser(r, sess.Username)
+
+	res, err := newAccessToken(sess.Username, sess.ID)
+	if err != nil {
+		requestLog(r).Error("Failed to generate token", "error", err)
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, res, refresh)
+	requestLog(r).Info("Refreshed token", "session", sess.ID)
+}
+
+// logoutHandler revokes the caller's token and ends its session, so neither
+// it nor the refresh token can be used again.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	if t.Contents["auth"] == "certificate" {
+		http.Error(w, "Client certificates cannot be logged out.", http.StatusBadRequest)
+		return
+	}
+
+	sessions.Revoke(t.ID, time.Unix(t.Exp, 0))
+	if sid := t.Contents["sid"]; sid != "" {
+		sessions.End(sid)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	requestLog(r).Info("Logged out", "session", t.Contents["sid"])
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_LOGOUT})
+}
+
+// revokeUser ends every session of a user and revokes all the tokens they
+// were issued, for when an account or its password is compromised.
+func revokeUser(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	if t.Contents["admin"] != "yes" {
+		http.Error(w, "Only admins can revoke sessions.", http.StatusForbidden)
+		return
+	}
+	username := mux.Vars(r)["username"]
+
+	ended := sessions.EndAll(username)
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	err := encoder.Encode(map[string]int{"ended": ended})
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Revoked sessions", "username", username, "ended", ended)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_REVOKE, Detail: "user " + username})
+}
+
+// sessionView is a session as listed by /sessions. Current marks the session
+// the request was made with.
+type sessionView struct {
+	session.Session
+	Current bool `json:"current"`
+}
+
+// listSessions lists where the caller is logged in. Admins can list the
+// sessions of another user with 'user', or of everyone with 'all'.
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	username := t.Contents["username"]
+	if r.FormValue("user") != "" || r.FormValue("all") != "" {
+		if t.Contents["admin"] != "yes" {
+			http.Error(w, "Only admins may view the sessions of others.", http.StatusForbidden)
+			return
+		}
+		username = r.FormValue("user")
+	}
+
+	list := sessions.List(username)
+	views := make([]sessionView, len(list))
+	for i, sess := range list {
+		views[i] = sessionView{Session: sess, Current: sess.ID == t.Contents["sid"]}
+	}
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	err := encoder.Encode(views)
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Listed sessions", "count", len(views))
+}
+
+// endSession ends one session of the caller, or of anyone for admins,
+// revoking its tokens.
+func endSession(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	sess := sessions.Get(id)
+	if sess == nil || (sess.Username != t.Contents["username"] && t.Contents["admin"] != "yes") {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	sessions.End(id)
+
+	w.WriteHeader(http.StatusNoContent)
+	requestLog(r).Info("Ended session", "session", id, "username", sess.Username)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_REVOKE, Detail: "session " + id + " of " + sess.Username})
+}
+
+func listDevices(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+
+	// Loop up devices using the device manager
+	var devices []*devm.Device
+	var revision int64
+	deviceManager.View(func(tx *devm.Tx) error {
+		devices = visibleDevices(tx, t)
+		revision = tx.Revision()
+		return nil
+	})
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fmt.Sprintf("\"r%d\"", revision))
+	err := encoder.Encode(devices)
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Listed devices", "count", len(devices))
+}
+
+func exportDevices(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+
+	// Same devices the caller would see in the list
+	var devices []*devm.Device
+	deviceManager.View(func(tx *devm.Tx) error {
+		devices = visibleDevices(tx, t)
+		return nil
+	})
+
+	format := r.FormValue("format")
+	switch format {
+	case "", "json":
+		format = "json"
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"devices.json\"")
+		encoder := json.NewEncoder(w)
+		err := encoder.Encode(devices)
+		if err != nil {
+			http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+			return
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"devices.csv\"")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Name", "Owner", "Device", "MAC", "Enabled", "Version"})
+		for _, d := range devices {
+			cw.Write([]string{d.Name, d.Owner, d.Device, d.MAC, strconv.FormatBool(d.Enabled), strconv.FormatInt(d.Version, 10)})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			requestLog(r).Error("Failed to write export", "error", err)
+			return
+		}
+	default:
+		http.Error(w, "Unsupported export format.", http.StatusBadRequest)
+		return
+	}
+	requestLog(r).Info("Exported devices", "count", len(devices), "format", format)
+}
+
+// visibleDevices returns every device for admins and only the caller's own
+// devices for everyone else.
+func visibleDevices(tx *devm.Tx, t *token.Token) []*devm.Device {
+	if t.Contents["admin"] == "yes" {
+		return tx.ListAll()
+	}
+	return tx.ListForUser(t.Contents["username"])
+}
+
+// canManage reports whether the caller may see and change dev.
+func canManage(t *token.Token, dev *devm.Device) bool {
+	return t.Contents["username"] == dev.Owner || t.Contents["admin"] == "yes"
+}
+
+// checkQuota refuses to give owner another device once they have reached
+// the device quota. Admins are not limited.
+func checkQuota(tx *devm.Tx, t *token.Token, owner string) error {
+	quota := current.Load().deviceQuota
+	if quota == 0 || t.Contents["admin"] == "yes" {
+		return nil
+	}
+	if len(tx.ListForUser(owner)) >= quota {
+		return &requestError{http.StatusForbidden, fmt.Sprintf("Device limit of %d reached.", quota)}
+	}
+	return nil
+}
+
+func getDevice(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+
+	// Get device from url
+	mac := mux.Vars(r)["did"]
+	var dev *devm.Device
+	deviceManager.View(func(tx *devm.Tx) error {
+		dev = tx.Get(mac)
+		return nil
+	})
+	if dev == nil || !canManage(t, dev) {
+		http.Error(w, "No such device exists.", http.StatusNotFound)
+		return
+	}
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", dev.ETag())
+	err := encoder.Encode(dev)
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func removeDevice(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+
+	// Get device from url
+	mac := mux.Vars(r)["did"]
+
+	var dev *devm.Device
+	applied := applyChange(w, r, func(tx *devm.Tx) error {
+		// See if the device exists and the caller owns it
+		dev = tx.Get(mac)
+		if dev == nil || !canManage(t, dev) {
+			return devm.ERR_NO_DEVICE
+		}
+		err := ifMatch(r, dev)
+		if err != nil {
+			return err
+		}
+		return tx.Remove(mac)
+	})
+	if !applied {
+		return
+	}
+
+	// Keep the removed device in the trash
+	trash.Put(dev, t.Contents["username"])
+	fmt.Fprint(w, "Device removed successfully.")
+	requestLog(r).Info("Removed device", "mac", mac)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_REMOVE, MAC: mac, Before: dev})
+}
+
+func addDevice(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+
+	// Parse device from request body
+	newDevice := new(devm.Device)
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(newDevice)
+	if err != nil {
+		http.Error(w, "Unable to parse request.", http.StatusBadRequest)
+		return
+	}
+
+	// Validate the new device
+	mac, err := net.ParseMAC(newDevice.MAC)
+	if err != nil {
+		http.Error(w, "Could not parse MAC address.", http.StatusBadRequest)
+		return
+	}
+	newDevice.MAC = mac.String()
+	re := regexp.MustCompile("[^0-9a-zA-Z\\-]")
+	newDevice.Device = re.ReplaceAllString(newDevice.Device, "")
+	if t.Contents["admin"] != "yes" {
+		newDevice.Owner = t.Contents["username"]
+	}
+	newDevice.Name = newDevice.Owner + "-" + newDevice.Device
+	newDevice.Enabled = true
+
+	// Add the device to the device manager, failing if it already exists
+	applied := applyChange(w, r, func(tx *devm.Tx) error {
+		if err := checkQuota(tx, t, newDevice.Owner); err != nil {
+			return err
+		}
+		return tx.Add(newDevice)
+	})
+	if !applied {
+		return
+	}
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", newDevice.ETag())
+	err = encoder.Encode(newDevice)
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Added device", "mac", newDevice.MAC)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_ADD, MAC: newDevice.MAC, After: newDevice})
+}
+
+func updateDevice(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+
+	// Get old MAC from url
+	oldMAC := mux.Vars(r)["did"]
+
+	// Parse device from request body
+	changedDevice := new(devm.Device)
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(changedDevice)
+	if err != nil {
+		http.Error(w, "Unable to parse request.", http.StatusBadRequest)
+		return
+	}
+
+	// Validate the new device
+	mac, err := net.ParseMAC(changedDevice.MAC)
+	if err != nil {
+		http.Error(w, "Could not parse MAC address.", http.StatusBadRequest)
+		return
 	}
+	changedDevice.MAC = mac.String()
+	re := regexp.MustCompile("[^0-9a-zA-Z\\-]")
+	changedDevice.Device = re.ReplaceAllString(changedDevice.Device, "")
 
-	log.Println("Serving requests on ", webPort)
-	log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", webPort), pubKey, privKey, nil))
-}
+	var oldDev *devm.Device
+	applied := applyChange(w, r, func(tx *devm.Tx) error {
+		oldDev = tx.Get(oldMAC)
+		if oldDev == nil || !canManage(t, oldDev) {
+			return devm.ERR_NO_DEVICE
+		}
+		err := ifMatch(r, oldDev)
+		if err != nil {
+			return err
+		}
 
-func corsMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println("[CORS] OPTIONS handler called.")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		// Only enforce owner if caller is not an admin
+		if t.Contents["admin"] != "yes" {
+			changedDevice.Owner = oldDev.Owner
+		}
+		changedDevice.Name = changedDevice.Owner + "-" + changedDevice.Device
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+		// If the mac has not changed
+		if oldMAC == changedDevice.MAC {
+			return tx.Set(changedDevice)
 		}
-		h.ServeHTTP(w, r)
+		// If the mac has changed, create a new device
+		if tx.Contains(changedDevice.MAC) {
+			return devm.ERR_DEVICE_EXISTS
+		}
+		tx.Remove(oldMAC)
+		return tx.Add(changedDevice)
 	})
-}
-
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	// Start the ldap connection
-	var ldapConn *ldap.Conn
-	var err error
-	ldapConn, err = ldap.Dial("tcp", fmt.Sprintf("%s:%d", ldapServer, ldapPort))
-	if err != nil {
-		log.Fatal("Failed to connect to LDAP server:", err)
-		http.Error(w, "Could not connect to LDAP database", http.StatusInternalServerError)
-	}
-	defer ldapConn.Close()
-
-	// Get the username and password.
-	username := r.FormValue("un")
-	password := r.FormValue("pw")
-
-	// Attempt LDAP bind
-	ldapUser := fmt.Sprintf(ldapSearchPath, username)
-	lde := ldapConn.Bind(ldapUser, password)
-	if lde != nil {
-		log.Println("User failed to authenticate")
-		http.Error(w, "Incorrect username or password", http.StatusBadRequest)
-		log.Println("[LOGIN](fail) ", username)
+	if !applied {
 		return
 	}
 
-	// Create JWT
-	t := token.NewToken(token.EXP_6HOUR)
-	t.Contents["username"] = username
-	if username == adminUser {
-		t.Contents["admin"] = "yes"
-	}
-	res, err := t.Sign(key)
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", changedDevice.ETag())
+	err = encoder.Encode(changedDevice)
 	if err != nil {
-		log.Println("Failed to generate token for user.")
-		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		requestLog(r).Error("Failed to write response", "error", err)
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
 		return
 	}
-	w.Write(res)
-	log.Println("[LOGIN](success) ", username)
+	requestLog(r).Info("Updated device", "mac", oldMAC, "new_mac", changedDevice.MAC)
+
+	// Enabling or disabling a device is audited as its own action
+	action := audit.ACTION_UPDATE
+	if oldDev.Enabled && !changedDevice.Enabled {
+		action = audit.ACTION_DISABLE
+	} else if !oldDev.Enabled && changedDevice.Enabled {
+		action = audit.ACTION_ENABLE
+	}
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: action, MAC: oldMAC, Before: oldDev, After: changedDevice})
 }
 
-func listDevices(w http.ResponseWriter, r *http.Request) {
+func listTrash(w http.ResponseWriter, r *http.Request) {
 	// Extract and validate JWT
 	t := validateToken(w, r)
 	if t == nil {
 		return
 	}
 
-	// Loop up devices using the device manager
-	var devices []*devm.Device
+	var devices []*devm.TrashedDevice
 	if t.Contents["admin"] == "yes" {
-		devices = deviceManager.ListAll()
+		devices = trash.ListAll()
 	} else {
-		devices = deviceManager.ListForUser(t.Contents["username"])
+		devices = trash.ListForUser(t.Contents["username"])
 	}
 
 	// Encode as json and write
@@ -167,10 +1547,10 @@ func listDevices(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
 		return
 	}
-	log.Println("[LIST](", len(devices), "devices ) ", t.Contents["username"])
+	requestLog(r).Info("Listed trash", "count", len(devices))
 }
 
-func removeDevice(w http.ResponseWriter, r *http.Request) {
+func restoreDevice(w http.ResponseWriter, r *http.Request) {
 	// Extract and validate JWT
 	t := validateToken(w, r)
 	if t == nil {
@@ -180,160 +1560,574 @@ func removeDevice(w http.ResponseWriter, r *http.Request) {
 	// Get device from url
 	mac := mux.Vars(r)["did"]
 
-	// See if the device exists
-	if deviceManager.Contains(mac) {
-		dev := deviceManager.Get(mac)
-		// Check if caller is owner
-		if t.Contents["username"] != dev.Owner && t.Contents["admin"] != "yes" {
-			http.Error(w, "No such device exists.", http.StatusBadRequest)
-			return
+	var td *devm.TrashedDevice
+	var restored *devm.Device
+	applied := applyChange(w, r, func(tx *devm.Tx) error {
+		// See if the device is in the trash and the caller owns it
+		td = trash.Get(mac)
+		if td == nil || !canManage(t, td.Device) {
+			return &requestError{http.StatusBadRequest, "No such deleted device exists."}
 		}
-	} else {
-		http.Error(w, "No such device exists.", http.StatusBadRequest)
+		if err := checkQuota(tx, t, td.Device.Owner); err != nil {
+			return err
+		}
+		// The MAC may have been registered again since it was deleted. Add
+		// a copy, the trash's own stays with the trash.
+		d := *td.Device
+		restored = &d
+		return tx.Add(restored)
+	})
+	if !applied {
 		return
 	}
+	// Clear it from the trash, unless the MAC was deleted again meanwhile
+	trash.Discard(td)
 
-	// Remove device using device manager
-	deviceManager.Remove(mac)
-	deviceManager.Save()
-	fmt.Fprint(w, "Device removed successfully.")
-	log.Println("[REMOVE](", mac, " ) ", t.Contents["username"])
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", restored.ETag())
+	err := encoder.Encode(restored)
+	if err != nil {
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Restored device", "mac", mac)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_RESTORE, MAC: mac, After: restored})
 }
 
-func addDevice(w http.ResponseWriter, r *http.Request) {
+func listConflicts(w http.ResponseWriter, r *http.Request) {
 	// Extract and validate JWT
 	t := validateToken(w, r)
 	if t == nil {
 		return
 	}
+	if t.Contents["admin"] != "yes" {
+		http.Error(w, "Only admins may view merge conflicts.", http.StatusForbidden)
+		return
+	}
 
-	// Parse device from request body
-	newDevice := new(devm.Device)
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(newDevice)
+	conflicts := deviceManager.Conflicts()
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	err := encoder.Encode(conflicts)
 	if err != nil {
-		http.Error(w, "Unable to parse request.", http.StatusBadRequest)
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
 		return
 	}
+	requestLog(r).Info("Listed conflicts", "count", len(conflicts))
+}
 
-	// Validate the new device
-	mac, err := net.ParseMAC(newDevice.MAC)
-	if err != nil {
-		http.Error(w, "Could not parse MAC address.", http.StatusBadRequest)
+func resolveConflict(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
 		return
 	}
-	newDevice.MAC = mac.String()
-	re := regexp.MustCompile("[^0-9a-zA-Z\\-]")
-	newDevice.Device = re.ReplaceAllString(newDevice.Device, "")
 	if t.Contents["admin"] != "yes" {
-		newDevice.Owner = t.Contents["username"]
+		http.Error(w, "Only admins may resolve merge conflicts.", http.StatusForbidden)
+		return
 	}
-	newDevice.Name = newDevice.Owner + "-" + newDevice.Device
-	newDevice.Enabled = true
 
-	// Check if the device already exists
-	if deviceManager.Contains(newDevice.MAC) {
-		http.Error(w, "This MAC address is already registered.", http.StatusBadRequest)
+	// Get device from url and the side to keep
+	mac := mux.Vars(r)["did"]
+	keep := r.FormValue("keep")
+	if keep != "ours" && keep != "theirs" {
+		http.Error(w, "'keep' must be 'ours' or 'theirs'.", http.StatusBadRequest)
+		return
+	}
+
+	err := deviceManager.ResolveConflict(mac, keep == "theirs")
+	if err == devm.ERR_NO_CONFLICT {
+		http.Error(w, "No such conflict exists.", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		requestLog(r).Error("Failed to resolve conflict", "mac", mac, "error", err)
+		http.Error(w, "Server failed to save changes.", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, "Conflict resolved successfully.")
+	requestLog(r).Info("Resolved conflict", "mac", mac, "kept", keep)
+	recordAudit(r, audit.Event{Actor: t.Contents["username"], Action: audit.ACTION_RESOLVE, MAC: mac, Detail: "kept " + keep})
+}
+
+func showStatus(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	if t.Contents["admin"] != "yes" {
+		http.Error(w, "Only admins may view server status.", http.StatusForbidden)
 		return
 	}
 
-	// Add the device to the device manager
-	deviceManager.Add(newDevice)
-	deviceManager.Save()
+	status := struct {
+		Devices   int
+		Revision  int64
+		Conflicts int
+		Watcher   devm.WatcherStatus
+	}{
+		Conflicts: len(deviceManager.Conflicts()),
+		Watcher:   deviceManager.WatcherStatus(),
+	}
+	deviceManager.View(func(tx *devm.Tx) error {
+		status.Devices = tx.NumDevices()
+		status.Revision = tx.Revision()
+		return nil
+	})
 
 	// Encode as json and write
 	encoder := json.NewEncoder(w)
 	w.Header().Set("Content-Type", "application/json")
-	err = encoder.Encode(newDevice)
+	err := encoder.Encode(status)
 	if err != nil {
 		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
 		return
 	}
-	log.Println("[ADD](", newDevice.MAC, " ) ", t.Contents["username"])
 }
 
-func updateDevice(w http.ResponseWriter, r *http.Request) {
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	// EventSource cannot set headers, so the token may come in the url
+	if r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", r.URL.Query().Get("token"))
+	}
 	// Extract and validate JWT
 	t := validateToken(w, r)
 	if t == nil {
 		return
 	}
-
-	// Get old MAC from url
-	oldMAC := mux.Vars(r)["did"]
-	oldDev := deviceManager.Get(oldMAC)
-	if oldDev == nil {
-		http.Error(w, "Device does not exist.", http.StatusBadRequest)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
 		return
 	}
 
-	// Parse device from request body
-	changedDevice := new(devm.Device)
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(changedDevice)
+	events, unsubscribe := deviceManager.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	requestLog(r).Info("Subscribed to events")
+
+	// The stream ends when the token would stop being accepted
+	var expired <-chan time.Time
+	if t.Contents["auth"] != "certificate" {
+		expiry := time.NewTimer(time.Until(time.Unix(t.Exp, 0)))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if t.Contents["admin"] != "yes" {
+				// Users only see events about their own devices, and
+				// nothing of how dhcpd restarts went
+				if e.Device != nil && e.Owner() != t.Contents["username"] &&
+					(e.Previous == nil || e.Previous.Owner != t.Contents["username"]) {
+					continue
+				}
+				e.Error = ""
+				e.Duration = 0
+			}
+			data, err := json.Marshal(&e)
+			if err != nil {
+				requestLog(r).Error("Failed to encode event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			if tokenRevoked(t) {
+				requestLog(r).Info("Event stream closed, token was revoked")
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-expired:
+			requestLog(r).Info("Event stream closed, token expired")
+			return
+		case <-r.Context().Done():
+			requestLog(r).Info("Event stream closed")
+			return
+		case <-shuttingDown:
+			requestLog(r).Info("Event stream closed for shutdown")
+			return
+		}
+	}
+}
+
+// webhookPayload is the body posted to webhook targets.
+type webhookPayload struct {
+	Event    string
+	Time     time.Time
+	Revision int64
+	Device   *devm.Device
+	Previous *devm.Device `json:",omitempty"`
+}
+
+// queueWebhooks queues a delivery for each device event of a change. It is
+// called while the registry is locked, so no event can be lost.
+func queueWebhooks(events []devm.Event) {
+	messages := make([]webhook.Message, 0, len(events))
+	for _, e := range events {
+		var name string
+		switch e.Type {
+		case devm.EVENT_ADDED:
+			name = "add"
+		case devm.EVENT_REMOVED:
+			name = "remove"
+		case devm.EVENT_UPDATED:
+			name = "update"
+			if e.Previous.Enabled && !e.Device.Enabled {
+				name = "disable"
+			} else if !e.Previous.Enabled && e.Device.Enabled {
+				name = "enable"
+			}
+		default:
+			continue
+		}
+		messages = append(messages, webhook.Message{Event: name, Payload: &webhookPayload{
+			Event:    name,
+			Time:     e.Time,
+			Revision: e.Revision,
+			Device:   e.Device,
+			Previous: e.Previous,
+		}})
+	}
+	err := webhooks.EnqueueAll(messages)
 	if err != nil {
-		http.Error(w, "Unable to parse request.", http.StatusBadRequest)
+		slog.Error("Failed to queue webhooks", "count", len(messages), "error", err)
+	}
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	if t.Contents["admin"] != "yes" {
+		http.Error(w, "Only admins may view webhook deliveries.", http.StatusForbidden)
 		return
 	}
 
-	// Validate the new device
-	mac, err := net.ParseMAC(changedDevice.MAC)
+	deliveries := webhooks.List()
+
+	// Encode as json and write
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	err := encoder.Encode(deliveries)
 	if err != nil {
-		http.Error(w, "Could not parse MAC address.", http.StatusBadRequest)
+		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func retryWebhook(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
 		return
 	}
-	changedDevice.MAC = mac.String()
-	re := regexp.MustCompile("[^0-9a-zA-Z\\-]")
-	changedDevice.Device = re.ReplaceAllString(changedDevice.Device, "")
-	// Only enforce owner if caller is not an admin
 	if t.Contents["admin"] != "yes" {
-		changedDevice.Owner = oldDev.Owner
+		http.Error(w, "Only admins may retry webhook deliveries.", http.StatusForbidden)
+		return
 	}
-	changedDevice.Name = changedDevice.Owner + "-" + changedDevice.Device
 
-	// If the mac has not changed
-	if oldMAC == changedDevice.MAC {
-		deviceManager.Set(changedDevice)
-	} else { // If the mac has changed, create a new device
-		if deviceManager.Contains(changedDevice.MAC) {
-			http.Error(w, "This MAC address is already registered.", http.StatusBadRequest)
+	id := mux.Vars(r)["id"]
+	if !webhooks.Retry(id) {
+		http.Error(w, "No such undelivered webhook exists.", http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "Webhook delivery scheduled.")
+	requestLog(r).Info("Retrying webhook", "delivery", id)
+}
+
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate JWT
+	t := validateToken(w, r)
+	if t == nil {
+		return
+	}
+	if t.Contents["admin"] != "yes" {
+		http.Error(w, "Only admins may view the audit log.", http.StatusForbidden)
+		return
+	}
+
+	// Build the filter from the query string
+	f := audit.Filter{
+		Actor:  r.FormValue("user"),
+		MAC:    r.FormValue("mac"),
+		Action: r.FormValue("action"),
+	}
+	var err error
+	if since := r.FormValue("since"); since != "" {
+		f.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Could not parse 'since', expected RFC 3339 time.", http.StatusBadRequest)
+			return
+		}
+	}
+	if until := r.FormValue("until"); until != "" {
+		f.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "Could not parse 'until', expected RFC 3339 time.", http.StatusBadRequest)
 			return
 		}
-		deviceManager.Remove(oldMAC)
-		deviceManager.Add(changedDevice)
 	}
-	deviceManager.Save()
+
+	events, err := auditLog.Query(f)
+	if err != nil {
+		requestLog(r).Error("Failed to read audit log", "error", err)
+		http.Error(w, "Server failed to read the audit log.", http.StatusInternalServerError)
+		return
+	}
 
 	// Encode as json and write
 	encoder := json.NewEncoder(w)
 	w.Header().Set("Content-Type", "application/json")
-	err = encoder.Encode(changedDevice)
+	err = encoder.Encode(events)
 	if err != nil {
-		log.Println(err)
 		http.Error(w, "Server failed to generate response", http.StatusInternalServerError)
 		return
 	}
-	log.Println("[UPDATE](", changedDevice.MAC, " ) ", t.Contents["username"])
+	requestLog(r).Info("Listed audit events", "count", len(events))
+}
+
+// requestError aborts a device manager transaction with an HTTP error.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+// conflictError aborts a transaction because the caller's If-Match no longer
+// matches the device.
+type conflictError struct {
+	current *devm.Device
+}
+
+func (e *conflictError) Error() string { return "Device has been changed." }
+
+// ifMatch enforces optimistic concurrency on a change to dev. The request
+// must carry the device's current ETag in If-Match.
+func ifMatch(r *http.Request, dev *devm.Device) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return &requestError{http.StatusPreconditionRequired, "An If-Match header with the device ETag is required."}
+	}
+	// If-Match uses the strong comparison, so weak tags never match
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == dev.ETag() {
+			return nil
+		}
+	}
+	return &conflictError{dev}
+}
+
+// applyChange runs change in a device manager transaction, or only previews
+// it when the request asks for a dry run. It returns true if the change was
+// saved; otherwise the response has already been written.
+func applyChange(w http.ResponseWriter, r *http.Request, change func(tx *devm.Tx) error) bool {
+	if isDryRun(r) {
+		diff, err := deviceManager.DryRun(change)
+		if err != nil {
+			writeChangeError(w, err)
+			return false
+		}
+		writeDiff(w, diff)
+		return false
+	}
+	err := deviceManager.Update(change)
+	if err != nil {
+		writeChangeError(w, err)
+		return false
+	}
+	return true
+}
+
+func writeChangeError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *requestError:
+		http.Error(w, e.msg, e.status)
+	case *conflictError:
+		// Give the caller the current state so they can retry
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", e.current.ETag())
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(e.current)
+	default:
+		switch err {
+		case devm.ERR_DEVICE_EXISTS:
+			http.Error(w, "This MAC address is already registered.", http.StatusBadRequest)
+		case devm.ERR_NO_DEVICE:
+			http.Error(w, "No such device exists.", http.StatusBadRequest)
+		default:
+			slog.Error("Failed to save changes", "error", err)
+			http.Error(w, "Server failed to save changes.", http.StatusInternalServerError)
+		}
+	}
+}
+
+// isDryRun reports whether the caller only wants to preview a change.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryrun"))
+	return dryRun
+}
+
+// writeDiff answers a dry-run request with the unified diff of the config.
+func writeDiff(w http.ResponseWriter, diff string) {
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	fmt.Fprint(w, diff)
+}
+
+// recordAudit stamps e with the caller's address and appends it to the
+// audit log. Failures are logged but never fail the request.
+func recordAudit(r *http.Request, e audit.Event) {
+	e.ClientIP = clientIP(r)
+	if err := auditLog.Record(e); err != nil {
+		requestLog(r).Error("Failed to write audit event", "error", err)
+	}
+}
+
+// clientIP returns the address of the client. Behind trusted proxies it is
+// the last address in X-Forwarded-For that was not added by one of them.
+func clientIP(r *http.Request) string {
+	host := peerIP(r)
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		host = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// requestScheme returns whether the client connected with http or https,
+// which a trusted proxy reports in X-Forwarded-Proto.
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && isTrustedProxy(peerIP(r)) {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// peerIP returns the address of the other end of the connection.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return listenUnix
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func validateToken(w http.ResponseWriter, r *http.Request) *token.Token {
 	tokenString := r.Header.Get("Authorization")
-	t, err := token.Validate([]byte(tokenString), key)
+	if tokenString == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return certificateToken(w, r)
+	}
+	validator := token.Validator{Issuer: tokenIssuer, Audience: tokenAudience, Leeway: token.DEFAULT_LEEWAY}
+	_, keys := tokenKeys()
+	t, err := validator.ValidateWith([]byte(tokenString), keys...)
 	if err != nil {
 		if err == token.ERR_EXPIRED {
 			http.Error(w, "Token is expired", http.StatusBadRequest)
 			return nil
-		} else if err == token.ERR_MALFORMED_TOKEN {
-			http.Error(w, "Invalid token", http.StatusBadRequest)
-			return nil
-		} else if err == token.ERR_INVALID_SIG {
+		} else if err == token.ERR_MALFORMED_TOKEN || err == token.ERR_INVALID_SIG || err == token.ERR_UNSUPPORTED_ALG ||
+			err == token.ERR_NOT_VALID_YET || err == token.ERR_WRONG_ISSUER || err == token.ERR_WRONG_AUDIENCE || err == token.ERR_UNKNOWN_KEY {
 			http.Error(w, "Invalid token", http.StatusBadRequest)
 			return nil
 		} else {
-			log.Println(err)
+			requestLog(r).Error("Failed to process token", "error", err)
 			http.Error(w, "Server failed to process token.", http.StatusInternalServerError)
 			return nil
 		}
 	}
+	if t.Subject == "" {
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+		return nil
+	}
+	if tokenRevoked(t) {
+		http.Error(w, "Token has been revoked", http.StatusBadRequest)
+		return nil
+	}
+	if sid := t.Contents["sid"]; sid != "" {
+		sessions.Touch(sid, clientIP(r), r.UserAgent())
+	}
+	// The rest of netreg reads the username from the private claim
+	t.Contents["username"] = t.Subject
+	setRequestUser(r, t.Subject)
+	return t
+}
+
+// tokenRevoked reports whether t was revoked, by logging out or ending its
+// session or all of its user's sessions.
+func tokenRevoked(t *token.Token) bool {
+	return sessions.Revoked(t.ID, t.Contents["sid"], t.Subject, time.Unix(t.IssuedAt, 0))
+}
+
+// certificateToken authenticates a request by its verified client
+// certificate, giving the user it names the same role they would get from
+// logging in.
+func certificateToken(w http.ResponseWriter, r *http.Request) *token.Token {
+	cert := r.TLS.VerifiedChains[0][0]
+	username, err := certs.Identity(cert, clientCertIdentity)
+	if err != nil {
+		requestLog(r).Info("Rejected client certificate", "subject", cert.Subject.String(), "error", err)
+		http.Error(w, "Client certificate does not name a user", http.StatusForbidden)
+		return nil
+	}
+	// Ending all of a user's sessions also shuts out the certificates they
+	// had been issued by then; a new certificate lets them back in
+	if sessions.Revoked("", "", username, cert.NotBefore) {
+		requestLog(r).Info("Rejected revoked client certificate", "subject", cert.Subject.String())
+		http.Error(w, "Client certificate has been revoked", http.StatusForbidden)
+		return nil
+	}
+	t := token.NewToken(0)
+	t.Subject = username
+	t.Contents["username"] = username
+	t.Contents["auth"] = "certificate"
+	if current.Load().admins[username] {
+		t.Contents["admin"] = "yes"
+	}
+	setRequestUser(r, username)
 	return t
 }
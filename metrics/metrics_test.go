@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	logins := r.NewCounter("netreg_logins_total", "Login attempts.", "result")
+	latency := r.NewHistogram("netreg_ldap_duration_seconds", "LDAP latency.", []float64{0.1, 1})
+	r.NewGaugeFunc("netreg_devices", "Registered devices.", func() []Sample {
+		return []Sample{{Labels: []string{"enabled"}, Value: 5}, {Labels: []string{"dis\"abled"}, Value: 2}}
+	}, "state")
+
+	logins.Inc("success")
+	logins.Inc("success")
+	logins.Inc("failure")
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE netreg_logins_total counter",
+		`netreg_logins_total{result="failure"} 1`,
+		`netreg_logins_total{result="success"} 2`,
+		"# TYPE netreg_ldap_duration_seconds histogram",
+		`netreg_ldap_duration_seconds_bucket{le="0.1"} 1`,
+		`netreg_ldap_duration_seconds_bucket{le="1"} 2`,
+		`netreg_ldap_duration_seconds_bucket{le="+Inf"} 3`,
+		"netreg_ldap_duration_seconds_sum 3.55",
+		"netreg_ldap_duration_seconds_count 3",
+		"# TYPE netreg_devices gauge",
+		`netreg_devices{state="enabled"} 5`,
+		`netreg_devices{state="dis\"abled"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatal("Missing '", line, "' in:\n", out)
+		}
+	}
+}
@@ -13,13 +13,37 @@ netregApp.config(function($routeProvider, $locationProvider) {
 		});
 });
 
-netregApp.controller("LoginCtrl", function($scope, $http, $location, $window) {
+// Exchange the stored refresh token for a new pair of tokens
+netregApp.factory("refreshTokens", function($http, $window) {
+	return function() {
+		return $http({
+			method: 'POST',
+			url: apiUrl+'/token/refresh',
+			data: {refresh_token: $window.localStorage['refresh']}
+		}).success(function(data) {
+			$window.localStorage['token'] = data.access_token;
+			$window.localStorage['refresh'] = data.refresh_token;
+		}).error(function() {
+			$window.localStorage.removeItem('token');
+			$window.localStorage.removeItem('refresh');
+		});
+	};
+});
+
+netregApp.controller("LoginCtrl", function($scope, $http, $location, $window, refreshTokens) {
+	// Carry on with the previous session if it is still going
+	if ($window.localStorage['refresh']) {
+		refreshTokens().success(function() {
+			$location.path("/home");
+		});
+	}
+
 	$scope.login = function(user) {
 		$http({
 			method: 'POST',
 			url: apiUrl+'/login',
 			data: user,
-			headers: {'Content-Type': 'application/x-www-form-urlencoded'},
+			headers: {'Content-Type': 'application/x-www-form-urlencoded', 'Accept': 'application/json'},
 			transformRequest: function(obj) {
 				var str = [];
 				for (var p in obj)
@@ -27,7 +51,8 @@ netregApp.controller("LoginCtrl", function($scope, $http, $location, $window) {
 				return str.join("&");
 			}
 		}).success(function(data) {
-			$window.localStorage['token'] = data;
+			$window.localStorage['token'] = data.access_token;
+			$window.localStorage['refresh'] = data.refresh_token;
 			$scope.loginErr = null;
 			console.log("Authentication successful");
 			$location.path("/home");
@@ -41,14 +66,22 @@ netregApp.controller("LoginCtrl", function($scope, $http, $location, $window) {
 	};	
 });
 
-netregApp.controller("HomeCtrl", function($scope, $http, $window, $location) {
+netregApp.controller("HomeCtrl", function($scope, $http, $window, $location, $timeout, refreshTokens) {
 	// Token management
 	$scope.getToken = function() {
 		var token = $window.localStorage['token'];
 		if (!token) {
 			return null;
 		}
-		var tokenBody = token.split('.')[1];
+		var parts = token.split('.');
+		if (parts.length != 3) {
+			return null;
+		}
+		// Tokens use unpadded base64url
+		var tokenBody = parts[1].replace(/-/g, '+').replace(/_/g, '/');
+		while (tokenBody.length % 4) {
+			tokenBody += '=';
+		}
 		var tokenJson = atob(tokenBody);
 		return JSON.parse(tokenJson);
 	};
@@ -61,7 +94,7 @@ netregApp.controller("HomeCtrl", function($scope, $http, $window, $location) {
 		$location.path("/");
 		return;
 	}
-	$scope.username = $scope.token.contents.username;
+	$scope.username = $scope.token.sub || $scope.token.contents.username;
 	if ($scope.token.contents.admin == "yes") {
 		$scope.isAdmin = true;
 	}
@@ -82,10 +115,69 @@ netregApp.controller("HomeCtrl", function($scope, $http, $window, $location) {
 	};
 	$scope.load();
 
+	// Reload whenever devices change, including changes made by others
+	var events;
+	var listen = function() {
+		events = new EventSource(apiUrl+'/events?token='+encodeURIComponent($window.localStorage['token']));
+		['added', 'updated', 'removed', 'reloaded'].forEach(function(type) {
+			events.addEventListener(type, function() {
+				// Don't throw away a form the user is filling in
+				var busy = $scope.devices && ($scope.devices.adding ||
+					$scope.devices.some(function(dev) { return dev.editing; }));
+				if (!busy) {
+					$scope.$apply($scope.load);
+				}
+			});
+		});
+	};
+	listen();
+
+	// Renew the access token a minute before it expires
+	var renewal;
+	var scheduleRefresh = function() {
+		var wait = ($scope.token.exp - 60) * 1000 - Date.now();
+		if (wait > 2147483647) {
+			// Too far off for a timer, tokens that never expire included
+			return;
+		}
+		var renewed = function() {
+			$scope.token = $scope.getToken();
+			events.close();
+			listen();
+			scheduleRefresh();
+		};
+		renewal = $timeout(function() {
+			// Another tab may have refreshed the shared tokens already
+			var latest = $scope.getToken();
+			if (latest && latest.exp > $scope.token.exp) {
+				renewed();
+				return;
+			}
+			refreshTokens().success(renewed).error(function() {
+				$scope.signout();
+			});
+		}, Math.max(wait, 0));
+	};
+	scheduleRefresh();
+
+	$scope.$on('$destroy', function() {
+		events.close();
+		$timeout.cancel(renewal);
+	});
+
 
 	// Functions
 	$scope.signout = function() {
-		$window.localStorage['token'] = null;
+		events.close();
+		$timeout.cancel(renewal);
+		// End the session on the server too, whether or not it works out
+		$http({
+			method: 'POST',
+			url: apiUrl+'/logout',
+			headers: {'Authorization': $window.localStorage['token']}
+		});
+		$window.localStorage.removeItem('token');
+		$window.localStorage.removeItem('refresh');
 		$location.path("/");
 	};
 
@@ -118,12 +210,15 @@ netregApp.controller("HomeCtrl", function($scope, $http, $window, $location) {
 			method: 'PUT',
 			url: apiUrl+'/devices/' + dev.MAC,
 			data: dev.updated,
-			headers: {'Authorization': $window.localStorage['token']}
+			headers: {'Authorization': $window.localStorage['token'], 'If-Match': '"' + dev.Version + '"'}
 		}).success(function(data) {
 			$scope.load();
 			$scope.message = "Successfully updated device.";
 		}).error(function(data, status) {
-			if (status >= 400 && status < 500) {
+			if (status == 412) {
+				$scope.load();
+				$scope.error = "This device was changed by someone else. Please review it and try again.";
+			} else if (status >= 400 && status < 500) {
 				$scope.error = data;
 			} else {
 				$scope.error = "Oops! Server error, please try again.";
@@ -154,12 +249,15 @@ netregApp.controller("HomeCtrl", function($scope, $http, $window, $location) {
 			$http({
 				method: 'DELETE',
 				url: apiUrl+'/devices/'+dev.MAC,
-				headers: {'Authorization': $window.localStorage['token']}
+				headers: {'Authorization': $window.localStorage['token'], 'If-Match': '"' + dev.Version + '"'}
 			}).success(function(data) {
 				$scope.load();
 				$scope.message = "Successfully deleted " + dev.Device;
 			}).error(function(data, status) {
-				if (status >= 400 && status < 500) {
+				if (status == 412) {
+					$scope.load();
+					$scope.error = "This device was changed by someone else. Please review it and try again.";
+				} else if (status >= 400 && status < 500) {
 					$scope.error = data;
 				} else {
 					$scope.error = "Oops! Server error, please try again.";
@@ -0,0 +1,409 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ERR_INVALID_REFRESH = errors.New("Refresh token is not valid")
+	ERR_REFRESH_REUSED  = errors.New("Refresh token was already used")
+	ERR_EXPIRED         = errors.New("Session is expired")
+)
+
+// Session is a login that can be extended with refresh tokens. Each refresh
+// hands out a new refresh token and bumps Generation, so a token from an
+// older generation being presented means it was copied.
+type Session struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	Generation int       `json:"generation"`
+	LastSeen   time.Time `json:"lastSeen"`
+	ClientIP   string    `json:"clientIP"`
+	UserAgent  string    `json:"userAgent"`
+}
+
+// LastSeen is only moved on once it is this far behind, so that not every
+// request rewrites the session file.
+const SAVE_ACTIVITY_EVERY = time.Minute
+
+// The refresh token just replaced is still accepted for this long, for
+// browser tabs sharing a token that refresh at the same time, or a retried
+// request whose first answer was lost.
+const REFRESH_GRACE = 30 * time.Second
+
+// entry is a session with the secret its refresh tokens are derived from.
+// Rotated is when the last refresh token was handed out.
+type entry struct {
+	Session
+	Secret  []byte    `json:"secret"`
+	Rotated time.Time `json:"rotated"`
+}
+
+// Store keeps sessions in a JSON file so that refresh tokens survive
+// restarts. The file holds secrets and is only readable by its owner.
+//
+// It also keeps what has been revoked: the IDs of single access tokens,
+// until they would have expired anyway, and for each user the time all of
+// their sessions were last ended.
+type Store struct {
+	entries       map[string]*entry
+	revokedTokens map[string]time.Time
+	revokedUsers  map[string]time.Time
+	file          string
+	stopChan      chan bool
+	sync.Mutex
+}
+
+// storeFile is the layout of the session file.
+type storeFile struct {
+	Sessions      []*entry             `json:"sessions"`
+	RevokedTokens map[string]time.Time `json:"revokedTokens"`
+	RevokedUsers  map[string]time.Time `json:"revokedUsers"`
+}
+
+func NewStore(file string) *Store {
+	return &Store{
+		entries:       make(map[string]*entry),
+		revokedTokens: make(map[string]time.Time),
+		revokedUsers:  make(map[string]time.Time),
+		file:          file,
+		stopChan:      make(chan bool),
+	}
+}
+
+// Load reads the session file. A missing file has no sessions.
+func (s *Store) Load() error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = make(map[string]*entry)
+	s.revokedTokens = make(map[string]time.Time)
+	s.revokedUsers = make(map[string]time.Time)
+	data, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f storeFile
+	if len(data) > 0 && data[0] == '[' {
+		// Files from before revocation are just the list of sessions
+		err = json.Unmarshal(data, &f.Sessions)
+	} else {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range f.Sessions {
+		s.entries[e.ID] = e
+	}
+	for jti, exp := range f.RevokedTokens {
+		s.revokedTokens[jti] = exp
+	}
+	for username, before := range f.RevokedUsers {
+		s.revokedUsers[username] = before
+	}
+	return nil
+}
+
+// Start purges expired sessions periodically until Stop is called.
+func (s *Store) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			s.Purge()
+			select {
+			case <-ticker.C:
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Store) Stop() {
+	s.stopChan <- true
+}
+
+// Create starts a session for username, logged in from clientIP with
+// userAgent, and returns its first refresh token. The session lasts for
+// lifetime after each refresh; 0 never expires.
+func (s *Store) Create(username, clientIP, userAgent string, lifetime time.Duration) (string, *Session, error) {
+	id := make([]byte, 16)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	e := &entry{
+		Session: Session{
+			ID:        hex.EncodeToString(id),
+			Username:  username,
+			Created:   time.Now(),
+			ClientIP:  clientIP,
+			UserAgent: userAgent,
+		},
+		Secret: secret,
+	}
+	e.extend(lifetime)
+	e.LastSeen = e.Created
+
+	s.Lock()
+	defer s.Unlock()
+	s.entries[e.ID] = e
+	s.save()
+	session := e.Session
+	return e.refreshToken(), &session, nil
+}
+
+// Refresh exchanges a refresh token for a new one and extends its session.
+// Presenting a token that was already exchanged ends the session, since
+// either it or its replacement is in the wrong hands; the session is still
+// returned so the caller can tell whose it was. Within REFRESH_GRACE of the
+// exchange the previous token instead gets the current one again.
+func (s *Store) Refresh(refresh string, lifetime time.Duration) (string, *Session, error) {
+	parts := strings.Split(refresh, ".")
+	if len(parts) != 3 {
+		return "", nil, ERR_INVALID_REFRESH
+	}
+	generation, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", nil, ERR_INVALID_REFRESH
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	e := s.entries[parts[0]]
+	if e == nil || generation > e.Generation || !hmac.Equal([]byte(refresh), []byte(e.tokenFor(generation))) {
+		return "", nil, ERR_INVALID_REFRESH
+	}
+	session := e.Session
+	if e.expired() {
+		delete(s.entries, e.ID)
+		s.save()
+		return "", &session, ERR_EXPIRED
+	}
+	if generation == e.Generation-1 && time.Since(e.Rotated) < REFRESH_GRACE {
+		e.extend(lifetime)
+		e.LastSeen = time.Now()
+		s.save()
+		session = e.Session
+		return e.refreshToken(), &session, nil
+	}
+	if generation < e.Generation {
+		delete(s.entries, e.ID)
+		s.save()
+		return "", &session, ERR_REFRESH_REUSED
+	}
+
+	e.Generation++
+	e.Rotated = time.Now()
+	e.extend(lifetime)
+	e.LastSeen = e.Rotated
+	s.save()
+	session = e.Session
+	return e.refreshToken(), &session, nil
+}
+
+// Get returns the session with id, or nil if it has ended.
+func (s *Store) Get(id string) *Session {
+	s.Lock()
+	defer s.Unlock()
+	e := s.entries[id]
+	if e == nil || e.expired() {
+		return nil
+	}
+	session := e.Session
+	return &session
+}
+
+// Touch records activity in the session with id from clientIP with
+// userAgent.
+func (s *Store) Touch(id, clientIP, userAgent string) {
+	s.Lock()
+	defer s.Unlock()
+	e := s.entries[id]
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	changed := e.ClientIP != clientIP || e.UserAgent != userAgent
+	stale := now.Sub(e.LastSeen) >= SAVE_ACTIVITY_EVERY
+	e.ClientIP = clientIP
+	e.UserAgent = userAgent
+	if changed || stale {
+		e.LastSeen = now
+		s.save()
+	}
+}
+
+// List returns the live sessions of username, or of everyone if username is
+// empty, most recently active first.
+func (s *Store) List(username string) []Session {
+	s.Lock()
+	defer s.Unlock()
+	list := []Session{}
+	for _, e := range s.entries {
+		if e.expired() || (username != "" && e.Username != username) {
+			continue
+		}
+		list = append(list, e.Session)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list
+}
+
+// End ends the session with id, so its refresh token stops working and
+// access tokens issued for it are revoked. It returns the session, or nil if
+// there was none.
+func (s *Store) End(id string) *Session {
+	s.Lock()
+	defer s.Unlock()
+	e := s.entries[id]
+	if e == nil {
+		return nil
+	}
+	delete(s.entries, id)
+	s.save()
+	session := e.Session
+	return &session
+}
+
+// EndAll ends every session of username and revokes every access token
+// issued to them until now, including ones not tied to a session. It
+// returns how many sessions were ended.
+func (s *Store) EndAll(username string) int {
+	s.Lock()
+	defer s.Unlock()
+	ended := 0
+	for id, e := range s.entries {
+		if e.Username == username {
+			delete(s.entries, id)
+			ended++
+		}
+	}
+	s.revokedUsers[username] = time.Now()
+	s.save()
+	return ended
+}
+
+// Revoke revokes the access token with ID jti. It is remembered until exp,
+// after which the token is no good anyway.
+func (s *Store) Revoke(jti string, exp time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.revokedTokens[jti] = exp
+	s.save()
+}
+
+// Revoked reports whether an access token may no longer be used. Tokens
+// tied to a session are revoked with it; older ones can only be revoked by
+// their ID or by ending all sessions of their user. Since issued is only
+// to the second, a token issued in the same second as EndAll is revoked.
+func (s *Store) Revoked(jti, sid, username string, issued time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.revokedTokens[jti]; jti != "" && ok {
+		return true
+	}
+	if sid != "" {
+		e := s.entries[sid]
+		return e == nil || e.expired() || e.Username != username
+	}
+	before, ok := s.revokedUsers[username]
+	return ok && !issued.After(before)
+}
+
+// Purge drops expired sessions, and revoked tokens that have expired, and
+// returns how many sessions were removed.
+func (s *Store) Purge() int {
+	s.Lock()
+	defer s.Unlock()
+	purged := 0
+	for id, e := range s.entries {
+		if e.expired() {
+			delete(s.entries, id)
+			purged++
+		}
+	}
+	now := time.Now()
+	forgotten := 0
+	for jti, exp := range s.revokedTokens {
+		if now.After(exp) {
+			delete(s.revokedTokens, jti)
+			forgotten++
+		}
+	}
+	if purged > 0 {
+		slog.Info("Purged expired sessions", "count", purged)
+	}
+	if purged > 0 || forgotten > 0 {
+		s.save()
+	}
+	return purged
+}
+
+// save writes the session file. The caller must hold the lock.
+func (s *Store) save() {
+	f := storeFile{
+		Sessions:      make([]*entry, 0, len(s.entries)),
+		RevokedTokens: s.revokedTokens,
+		RevokedUsers:  s.revokedUsers,
+	}
+	for _, e := range s.entries {
+		f.Sessions = append(f.Sessions, e)
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode sessions", "error", err)
+		return
+	}
+	err = ioutil.WriteFile(s.file, data, 0600)
+	if err != nil {
+		slog.Error("Failed to write sessions", "file", s.file, "error", err)
+	}
+}
+
+func (e *entry) extend(lifetime time.Duration) {
+	if lifetime > 0 {
+		e.Expires = time.Now().Add(lifetime)
+	}
+}
+
+func (e *entry) expired() bool {
+	return !e.Expires.IsZero() && time.Now().After(e.Expires)
+}
+
+func (e *entry) refreshToken() string {
+	return e.tokenFor(e.Generation)
+}
+
+// tokenFor derives the refresh token of a generation from the session
+// secret, so old tokens can be recognised without storing them.
+func (e *entry) tokenFor(generation int) string {
+	mac := hmac.New(sha256.New, e.Secret)
+	mac.Write([]byte(e.ID + "." + strconv.Itoa(generation)))
+	return e.ID + "." + strconv.Itoa(generation) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
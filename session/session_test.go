@@ -0,0 +1,172 @@
+package session
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefresh(t *testing.T) {
+	os.Remove("TestSessions.json")
+	defer os.Remove("TestSessions.json")
+	s := NewStore("TestSessions.json")
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, session, err := s.Create("dfindley", "10.0.0.1", "curl", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "dfindley" || s.Get(session.ID) == nil {
+		t.Fatal("Session was not created.")
+	}
+
+	// Refresh tokens survive a restart
+	s = NewStore("TestSessions.json")
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	second, refreshed, err := s.Refresh(first, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || refreshed.ID != session.ID || refreshed.Generation != 1 {
+		t.Fatal("Refresh did not rotate the token.")
+	}
+	if !refreshed.Expires.After(session.Expires) {
+		t.Fatal("Refresh did not extend the session.")
+	}
+
+	// Forged and unknown tokens are rejected without touching the session
+	forged := strings.Replace(second, ".1.", ".0.", 1)
+	if _, _, err := s.Refresh(forged, time.Hour); err != ERR_INVALID_REFRESH {
+		t.Fatal("Expected a forged token to be rejected, got", err)
+	}
+	if _, _, err := s.Refresh("nope", time.Hour); err != ERR_INVALID_REFRESH {
+		t.Fatal("Expected a malformed token to be rejected, got", err)
+	}
+	if s.Get(session.ID) == nil {
+		t.Fatal("A forged token ended the session.")
+	}
+
+	// Another tab refreshing with the same token at the same time gets the
+	// current token rather than ending the session
+	again, _, err := s.Refresh(first, time.Hour)
+	if err != nil || again != second {
+		t.Fatal("Refresh within the grace period failed: ", err)
+	}
+
+	// Using the first token again later ends the session for everyone
+	s.entries[session.ID].Rotated = time.Now().Add(-REFRESH_GRACE)
+	_, reused, err := s.Refresh(first, time.Hour)
+	if err != ERR_REFRESH_REUSED || reused == nil || reused.Username != "dfindley" {
+		t.Fatal("Expected reuse to be detected, got", err)
+	}
+	if _, _, err := s.Refresh(second, time.Hour); err != ERR_INVALID_REFRESH {
+		t.Fatal("The latest token should stop working after reuse, got", err)
+	}
+	if s.Get(session.ID) != nil {
+		t.Fatal("Session outlived the reuse of its refresh token.")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	os.Remove("TestSessions.json")
+	defer os.Remove("TestSessions.json")
+	s := NewStore("TestSessions.json")
+
+	refresh, session, err := s.Create("dfindley", "10.0.0.1", "curl", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forever, err := s.Create("ykim", "10.0.0.1", "curl", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err := s.Refresh(refresh, time.Hour); err != ERR_EXPIRED {
+		t.Fatal("Expected an expired session, got", err)
+	}
+	if s.Get(session.ID) != nil || s.Purge() != 0 {
+		t.Fatal("Expired session was not removed.")
+	}
+	if s.Get(forever.ID) == nil {
+		t.Fatal("A session without a lifetime expired.")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	os.Remove("TestSessions.json")
+	defer os.Remove("TestSessions.json")
+	s := NewStore("TestSessions.json")
+	issued := time.Now().Add(-time.Minute)
+
+	refresh, session, err := s.Create("dfindley", "10.0.0.1", "curl", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := s.Create("dfindley", "10.0.0.1", "curl", time.Hour)
+	_, kept, _ := s.Create("ykim", "10.0.0.1", "curl", time.Hour)
+	if s.Revoked("a", session.ID, "dfindley", issued) {
+		t.Fatal("A token of a live session was revoked.")
+	}
+	if !s.Revoked("a", session.ID, "ykim", issued) {
+		t.Fatal("A token was accepted for someone else's session.")
+	}
+
+	// Logging out revokes the token and ends its session
+	s.Revoke("a", time.Now().Add(time.Hour))
+	s.Revoke("old", time.Now().Add(-time.Hour))
+	if s.End(session.ID) == nil || !s.Revoked("a", "", "dfindley", issued) || !s.Revoked("b", session.ID, "dfindley", issued) {
+		t.Fatal("Logging out did not revoke the session.")
+	}
+	if _, _, err := s.Refresh(refresh, time.Hour); err != ERR_INVALID_REFRESH {
+		t.Fatal("Refresh token outlived its session, got", err)
+	}
+
+	// Revocations survive a restart, until the tokens would have expired
+	s = NewStore("TestSessions.json")
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s.Purge()
+	if !s.Revoked("a", "", "dfindley", issued) {
+		t.Fatal("Revocation was lost on restart.")
+	}
+	if _, ok := s.revokedTokens["old"]; ok {
+		t.Fatal("Expired revocation was not purged.")
+	}
+
+	// Ending all sessions of a user leaves everyone else alone
+	if s.EndAll("dfindley") != 1 || !s.Revoked("b", other.ID, "dfindley", issued) || !s.Revoked("b", "", "dfindley", issued) {
+		t.Fatal("Not every session of the user was ended.")
+	}
+	if s.Revoked("b", kept.ID, "ykim", issued) || s.Revoked("b", "", "dfindley", time.Now().Add(time.Second)) {
+		t.Fatal("Ending sessions revoked too much.")
+	}
+}
+
+func TestList(t *testing.T) {
+	os.Remove("TestSessions.json")
+	defer os.Remove("TestSessions.json")
+	s := NewStore("TestSessions.json")
+
+	_, first, _ := s.Create("dfindley", "10.0.0.1", "curl", time.Hour)
+	_, second, _ := s.Create("dfindley", "10.0.0.2", "curl", time.Hour)
+	s.Create("ykim", "10.0.0.3", "curl", time.Hour)
+	if len(s.List("dfindley")) != 2 || len(s.List("")) != 3 {
+		t.Fatal("Listed the wrong sessions.")
+	}
+
+	// Using a session from somewhere else is recorded straight away
+	s.Touch(first.ID, "10.0.0.9", "Firefox")
+	list := s.List("dfindley")
+	if list[0].ID != first.ID || list[0].ClientIP != "10.0.0.9" || list[0].UserAgent != "Firefox" {
+		t.Fatalf("Activity was not recorded: %+v", list[0])
+	}
+	if list[1].ID != second.ID {
+		t.Fatal("Sessions are not ordered by activity.")
+	}
+}
@@ -0,0 +1,226 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Keyring holds the keys tokens are signed with, persisted to a file so that
+// tokens outlive restarts. The newest key signs; keys it replaced keep
+// validating for the retain period so tokens they signed stay good.
+type Keyring struct {
+	file     string
+	alg      string
+	retain   time.Duration
+	entries  []*keyEntry
+	stopChan chan bool
+	sync.RWMutex
+}
+
+// keyEntry is a key as stored in the key file, newest first.
+type keyEntry struct {
+	ID      string    `json:"kid"`
+	Alg     string    `json:"alg"`
+	Created time.Time `json:"created"`
+	Retired time.Time `json:"retired"`
+	Key     []byte    `json:"key"`
+	key     *Key
+}
+
+// NewKeyring creates a keyring stored in file that generates alg keys.
+func NewKeyring(file, alg string, retain time.Duration) *Keyring {
+	return &Keyring{
+		file:     file,
+		alg:      alg,
+		retain:   retain,
+		stopChan: make(chan bool),
+	}
+}
+
+// Load reads the key file, creating it with a new key on first run.
+func (kr *Keyring) Load() error {
+	kr.Lock()
+	defer kr.Unlock()
+	data, err := ioutil.ReadFile(kr.file)
+	if os.IsNotExist(err) {
+		return kr.rotate()
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*keyEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.key, err = parseEntryKey(e.Alg, e.Key)
+		if err != nil {
+			return err
+		}
+		e.key.id = e.ID
+	}
+	kr.entries = entries
+	if len(kr.entries) == 0 || kr.entries[0].key.alg != kr.alg {
+		// Start signing with the configured algorithm
+		return kr.rotate()
+	}
+	return nil
+}
+
+func parseEntryKey(alg string, data []byte) (*Key, error) {
+	if alg == ALG_HS256 {
+		return NewHMACKey(data), nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != alg {
+		return nil, ERR_UNSUPPORTED_ALG
+	}
+	return key, nil
+}
+
+// Rotate makes a new signing key. The old one only validates from now on.
+func (kr *Keyring) Rotate() error {
+	kr.Lock()
+	defer kr.Unlock()
+	return kr.rotate()
+}
+
+func (kr *Keyring) rotate() error {
+	k, err := GenerateKey(kr.alg)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if k.alg == ALG_HS256 {
+		data = k.secret
+	} else {
+		data, err = x509.MarshalPKCS8PrivateKey(k.private)
+		if err != nil {
+			return err
+		}
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	k.id = hex.EncodeToString(id)
+
+	now := time.Now()
+	entries := []*keyEntry{{ID: k.id, Alg: k.alg, Created: now, Key: data, key: k}}
+	for _, e := range kr.entries {
+		if e.Retired.IsZero() {
+			e.Retired = now
+		}
+		if now.Sub(e.Retired) < kr.retain {
+			entries = append(entries, e)
+		}
+	}
+	kr.entries = entries
+	return kr.save()
+}
+
+// save writes the key file through a temporary file, so a crash cannot
+// leave it half written and log everyone out.
+func (kr *Keyring) save() error {
+	data, err := json.MarshalIndent(kr.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(kr.file), ".netreg-keys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// The file holds private keys
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), kr.file)
+}
+
+// Start rotates the signing key once it is older than every, until Stop is
+// called. An every of 0 never rotates.
+func (kr *Keyring) Start(every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kr.RLock()
+				due := time.Since(kr.entries[0].Created) >= every
+				kr.RUnlock()
+				if !due {
+					continue
+				}
+				if err := kr.Rotate(); err != nil {
+					slog.Error("Could not rotate token signing key", "error", err)
+					continue
+				}
+				slog.Info("Rotated token signing key", "kid", kr.SigningKey().ID())
+			case <-kr.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (kr *Keyring) Stop() {
+	close(kr.stopChan)
+}
+
+// SigningKey returns the key new tokens are signed with.
+func (kr *Keyring) SigningKey() *Key {
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.entries[0].key
+}
+
+// Keys returns the keys tokens may be signed with: the signing key and the
+// recently retired ones.
+func (kr *Keyring) Keys() []*Key {
+	kr.RLock()
+	defer kr.RUnlock()
+	var keys []*Key
+	for _, e := range kr.entries {
+		if e.Retired.IsZero() || time.Since(e.Retired) < kr.retain {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// JWKS returns the public keys of an asymmetric keyring.
+func (kr *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range kr.Keys() {
+		if jwk, ok := k.PublicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
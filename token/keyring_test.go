@@ -0,0 +1,97 @@
+package token
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyring(test *testing.T) {
+	os.Remove("TestKeys.json")
+	defer os.Remove("TestKeys.json")
+
+	// The first load generates a key
+	kr := NewKeyring("TestKeys.json", ALG_EDDSA, time.Hour)
+	if err := kr.Load(); err != nil {
+		test.Fatal(err)
+	}
+	first := kr.SigningKey()
+	if first.ID() == "" || first.Alg() != ALG_EDDSA {
+		test.Fatal("Generated key has no kid or the wrong algorithm.")
+	}
+	if info, err := os.Stat("TestKeys.json"); err != nil || info.Mode().Perm() != 0600 {
+		test.Fatal("Key file should only be readable by its owner: ", err)
+	}
+	t := NewToken(EXP_1HOUR)
+	t.Subject = "dfindley"
+	oldToken, err := t.SignWith(first)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// The same key comes back after a restart
+	kr = NewKeyring("TestKeys.json", ALG_EDDSA, time.Hour)
+	if err := kr.Load(); err != nil {
+		test.Fatal(err)
+	}
+	if kr.SigningKey().ID() != first.ID() {
+		test.Fatal("Signing key changed across a reload.")
+	}
+
+	// After rotating, old tokens still validate but new ones use the new key
+	if err := kr.Rotate(); err != nil {
+		test.Fatal(err)
+	}
+	second := kr.SigningKey()
+	if second.ID() == first.ID() {
+		test.Fatal("Rotate did not make a new key.")
+	}
+	v := Validator{Leeway: DEFAULT_LEEWAY}
+	if _, err := v.ValidateWith(oldToken, kr.Keys()...); err != nil {
+		test.Fatal("Token from the retired key was rejected:", err)
+	}
+	newToken, _ := t.SignWith(second)
+	if _, err := v.ValidateWith(newToken, first); err != ERR_UNKNOWN_KEY {
+		test.Fatal("Expected the kid to pick the key, got", err)
+	}
+	if len(kr.JWKS().Keys) != 2 {
+		test.Fatal("JWKS should list the signing and retired keys.")
+	}
+
+	// Retired keys are dropped once the retain period passes
+	kr = NewKeyring("TestKeys.json", ALG_EDDSA, 0)
+	if err := kr.Load(); err != nil {
+		test.Fatal(err)
+	}
+	if err := kr.Rotate(); err != nil {
+		test.Fatal(err)
+	}
+	if len(kr.Keys()) != 1 {
+		test.Fatal("Retired keys outlived the retain period.")
+	}
+	if _, err := v.ValidateWith(oldToken, kr.Keys()...); err != ERR_UNKNOWN_KEY {
+		test.Fatal("Expected a token from a dropped key to be rejected, got", err)
+	}
+}
+
+func TestKeyringAlgorithmChange(test *testing.T) {
+	os.Remove("TestKeys.json")
+	defer os.Remove("TestKeys.json")
+
+	kr := NewKeyring("TestKeys.json", ALG_HS256, time.Hour)
+	if err := kr.Load(); err != nil {
+		test.Fatal(err)
+	}
+	old := kr.SigningKey()
+
+	kr = NewKeyring("TestKeys.json", ALG_ES256, time.Hour)
+	if err := kr.Load(); err != nil {
+		test.Fatal(err)
+	}
+	if kr.SigningKey().Alg() != ALG_ES256 || len(kr.Keys()) != 2 {
+		test.Fatal("Changing the algorithm should rotate to a key for it.")
+	}
+	if kr.Keys()[1].ID() != old.ID() {
+		test.Fatal("The HMAC key should keep validating after the change.")
+	}
+}
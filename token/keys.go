@@ -0,0 +1,248 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+const (
+	ALG_HS256 = "HS256"
+	ALG_RS256 = "RS256"
+	ALG_ES256 = "ES256"
+	ALG_EDDSA = "EdDSA"
+)
+
+var ERR_VERIFY_ONLY = errors.New("Key cannot sign tokens")
+
+// Key signs or verifies tokens with one algorithm. Asymmetric keys loaded
+// from a public key can only verify.
+type Key struct {
+	id      string
+	alg     string
+	secret  []byte
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// NewHMACKey makes an HS256 key from a shared secret.
+func NewHMACKey(secret []byte) *Key {
+	return &Key{alg: ALG_HS256, secret: secret}
+}
+
+// NewKey wraps an RSA, P-256 ECDSA or Ed25519 private or public key,
+// choosing the algorithm from its type.
+func NewKey(k interface{}) (*Key, error) {
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		return newKey(ALG_RS256, k, &k.PublicKey)
+	case *ecdsa.PrivateKey:
+		return newKey(ALG_ES256, k, &k.PublicKey)
+	case ed25519.PrivateKey:
+		return newKey(ALG_EDDSA, k, k.Public())
+	case *rsa.PublicKey:
+		return newKey(ALG_RS256, nil, k)
+	case *ecdsa.PublicKey:
+		return newKey(ALG_ES256, nil, k)
+	case ed25519.PublicKey:
+		return newKey(ALG_EDDSA, nil, k)
+	}
+	return nil, fmt.Errorf("unsupported key type %T", k)
+}
+
+func newKey(alg string, private crypto.Signer, public crypto.PublicKey) (*Key, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 needs a P-256 key")
+		}
+	}
+	return &Key{alg: alg, private: private, public: public}, nil
+}
+
+// LoadKey reads a PEM encoded private or public key, in PKCS #1, SEC 1,
+// PKCS #8 or PKIX form.
+func LoadKey(file string) (*Key, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", file)
+	}
+	var k interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		k, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		k, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", file, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return NewKey(k)
+}
+
+// GenerateKey makes a new random key for alg.
+func GenerateKey(alg string) (*Key, error) {
+	switch alg {
+	case ALG_HS256:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return NewHMACKey(secret), nil
+	case ALG_RS256:
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(k)
+	case ALG_ES256:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(k)
+	case ALG_EDDSA:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(k)
+	}
+	return nil, ERR_UNSUPPORTED_ALG
+}
+
+func (k *Key) Alg() string {
+	return k.alg
+}
+
+// CanSign reports whether k can sign tokens, rather than only verify them.
+func (k *Key) CanSign() bool {
+	return k.alg == ALG_HS256 || k.private != nil
+}
+
+// ID is the key's kid, which tokens it signs carry in their header.
+func (k *Key) ID() string {
+	return k.id
+}
+
+func (k *Key) sign(payload []byte) ([]byte, error) {
+	if k.alg == ALG_HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(payload)
+		return mac.Sum(nil), nil
+	}
+	if k.private == nil {
+		return nil, ERR_VERIFY_ONLY
+	}
+	switch k.alg {
+	case ALG_RS256:
+		digest := sha256.Sum256(payload)
+		return k.private.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ALG_ES256:
+		// JWS wants the two integers side by side, not ASN.1
+		digest := sha256.Sum256(payload)
+		r, s, err := ecdsa.Sign(rand.Reader, k.private.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case ALG_EDDSA:
+		return k.private.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	return nil, ERR_UNSUPPORTED_ALG
+}
+
+func (k *Key) verify(payload, sig []byte) bool {
+	switch k.alg {
+	case ALG_HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(payload)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case ALG_RS256:
+		digest := sha256.Sum256(payload)
+		return rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	case ALG_ES256:
+		if len(sig) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(payload)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k.public.(*ecdsa.PublicKey), digest[:], r, s)
+	case ALG_EDDSA:
+		return ed25519.Verify(k.public.(ed25519.PublicKey), payload, sig)
+	}
+	return false
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK returns the public half of k. HMAC secrets have none, so ok is
+// false for them.
+func (k *Key) PublicJWK() (jwk JWK, ok bool) {
+	jwk = JWK{Kid: k.id, Use: "sig", Alg: k.alg}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(public.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		jwk.X = b64.EncodeToString(public.X.FillBytes(x))
+		jwk.Y = b64.EncodeToString(public.Y.FillBytes(y))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64.EncodeToString(public)
+	default:
+		return jwk, false
+	}
+	return jwk, true
+}
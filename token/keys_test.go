@@ -0,0 +1,128 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writePEM(test *testing.T, file, blockType string, der []byte) {
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestAsymmetricKeys(test *testing.T) {
+	defer os.Remove("TestKey.pem")
+	defer os.Remove("TestPub.pem")
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	keys := []struct {
+		alg       string
+		blockType string
+		der       []byte
+		public    interface{}
+	}{
+		{ALG_RS256, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), &rsaKey.PublicKey},
+		{ALG_ES256, "EC PRIVATE KEY", ecDER, &ecKey.PublicKey},
+		{ALG_EDDSA, "PRIVATE KEY", edDER, edKey.Public()},
+	}
+
+	for _, k := range keys {
+		writePEM(test, "TestKey.pem", k.blockType, k.der)
+		key, err := LoadKey("TestKey.pem")
+		if err != nil {
+			test.Fatal(err)
+		}
+		if key.Alg() != k.alg {
+			test.Fatal("Expected", k.alg, "got", key.Alg())
+		}
+
+		t := NewToken(EXP_1HOUR)
+		t.Subject = "dfindley"
+		webtoken, err := t.SignWith(key)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		// Other services only need the public key to check tokens
+		pubDER, _ := x509.MarshalPKIXPublicKey(k.public)
+		writePEM(test, "TestPub.pem", "PUBLIC KEY", pubDER)
+		pub, err := LoadKey("TestPub.pem")
+		if err != nil {
+			test.Fatal(err)
+		}
+		v := Validator{Leeway: DEFAULT_LEEWAY}
+		vt, err := v.ValidateWith(webtoken, pub)
+		if err != nil || vt.Subject != "dfindley" {
+			test.Fatal(k.alg, "token did not validate:", err)
+		}
+		if !key.CanSign() || pub.CanSign() {
+			test.Fatal("Only the private", k.alg, "key should be able to sign.")
+		}
+		if _, err := t.SignWith(pub); err != ERR_VERIFY_ONLY {
+			test.Fatal("A public key should not sign tokens, got", err)
+		}
+
+		// Tampering breaks the signature
+		tampered := []byte(strings.Replace(string(webtoken), ".", ".e", 1))
+		if _, err := v.ValidateWith(tampered, pub); err == nil {
+			test.Fatal(k.alg, "accepted a tampered token")
+		}
+
+		// The key's algorithm must match the header
+		if _, err := v.ValidateWith(webtoken, NewHMACKey(pubDER)); err != ERR_UNSUPPORTED_ALG {
+			test.Fatal("Checked an", k.alg, "token with an HMAC key, got", err)
+		}
+
+		jwk, ok := pub.PublicJWK()
+		if !ok || jwk.Alg != k.alg || jwk.Use != "sig" {
+			test.Fatalf("Bad public JWK: %+v", jwk)
+		}
+	}
+
+	if _, ok := NewHMACKey([]byte("secret")).PublicJWK(); ok {
+		test.Fatal("HMAC secrets must not be published.")
+	}
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if _, err := NewKey(small); err == nil {
+		test.Fatal("Expected a 1024 bit RSA key to be rejected.")
+	}
+}
+
+// The Ed25519 example from RFC 8037 appendix A.4. Ed25519 signatures are
+// deterministic, so the signature must match exactly.
+func TestEdDSAInterop(test *testing.T) {
+	d, _ := b64.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	key, err := NewKey(ed25519.NewKeyFromSeed(d))
+	if err != nil {
+		test.Fatal(err)
+	}
+	jwk, _ := key.PublicJWK()
+	if jwk.X != "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo" {
+		test.Fatal("Wrong public key: ", jwk.X)
+	}
+
+	payload := "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc"
+	sig, err := key.sign([]byte(payload))
+	if err != nil {
+		test.Fatal(err)
+	}
+	want := "hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg"
+	if b64.EncodeToString(sig) != want {
+		test.Fatal("Signature does not match RFC 8037: ", b64.EncodeToString(sig))
+	}
+}
@@ -1,12 +1,15 @@
+// Package token creates and checks JSON Web Tokens (RFC 7519) signed with
+// HMAC-SHA256, RSA, ECDSA or Ed25519 keys.
 package token
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -24,94 +27,249 @@ const (
 	EXP_NEVER  = 1<<63 - 1
 )
 
+// expNames lets settings pick one of the EXP_* lifetimes by name.
+var expNames = map[string]int64{
+	"1hour":  EXP_1HOUR,
+	"6hour":  EXP_6HOUR,
+	"12hour": EXP_12HOUR,
+	"1day":   EXP_1DAY,
+	"2day":   EXP_2DAY,
+	"3day":   EXP_3DAY,
+	"1week":  EXP_1WEEK,
+	"2week":  EXP_2WEEK,
+	"3week":  EXP_3WEEK,
+	"4week":  EXP_4WEEK,
+	"never":  EXP_NEVER,
+}
+
+// ParseExp returns the EXP_* lifetime called name, such as "6hour" for
+// EXP_6HOUR.
+func ParseExp(name string) (int64, error) {
+	exp, ok := expNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown token lifetime %q, use one of 1hour, 6hour, 12hour, 1day, 2day, 3day, 1week, 2week, 3week, 4week or never", name)
+	}
+	return exp, nil
+}
+
+// DEFAULT_LEEWAY is how far apart the clocks of the issuer and the checker
+// may be before time based claims are rejected.
+const DEFAULT_LEEWAY = time.Minute
+
 var (
 	ERR_MALFORMED_TOKEN = errors.New("Token does not contain header, body, and signature only")
 	ERR_INVALID_SIG     = errors.New("Token signature is not valid.")
 	ERR_EXPIRED         = errors.New("Token is expired")
+	ERR_UNSUPPORTED_ALG = errors.New("Token is not signed with a supported algorithm")
+	ERR_NOT_VALID_YET   = errors.New("Token is not valid yet")
+	ERR_WRONG_ISSUER    = errors.New("Token was issued by someone else")
+	ERR_WRONG_AUDIENCE  = errors.New("Token is intended for someone else")
+	ERR_UNKNOWN_KEY     = errors.New("Token is signed with an unknown key")
 )
 
-var jwt_header []byte
+// now is replaced in tests.
+var now = time.Now
 
-func init() {
-	jwth := []byte(`{"alg":"HS256","typ":"JWT"}`)
-	jwt_header = make([]byte, base64.URLEncoding.EncodedLen(len(jwth)))
-	base64.URLEncoding.Encode(jwt_header, jwth)
+var b64 = base64.RawURLEncoding
+
+type header struct {
+	Alg  string   `json:"alg"`
+	Typ  string   `json:"typ,omitempty"`
+	Kid  string   `json:"kid,omitempty"`
+	Crit []string `json:"crit,omitempty"`
 }
 
+// Token holds the registered claims of a JWT. Contents is a private claim
+// carrying netreg's own fields, which older clients read the username and
+// role from.
 type Token struct {
-	Contents map[string]string `json:"contents"`
-	Exp      int64             `json:"exp"`
+	Subject   string            `json:"sub,omitempty"`
+	Issuer    string            `json:"iss,omitempty"`
+	Audience  Audience          `json:"aud,omitempty"`
+	ID        string            `json:"jti,omitempty"`
+	IssuedAt  int64             `json:"iat,omitempty"`
+	NotBefore int64             `json:"nbf,omitempty"`
+	Exp       int64             `json:"exp"`
+	Contents  map[string]string `json:"contents,omitempty"`
 }
 
+// Audience is the aud claim, which is either a single string or an array.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a Audience) contains(aud string) bool {
+	for _, a := range a {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// NewToken creates a token that expires exp seconds from now, with a
+// random ID.
 func NewToken(exp int64) *Token {
-	return &Token{
-		Contents: make(map[string]string),
-		Exp:      time.Now().Unix() + exp,
+	issued := now().Unix()
+	id := make([]byte, 16)
+	rand.Read(id)
+	t := &Token{
+		ID:        hex.EncodeToString(id),
+		IssuedAt:  issued,
+		NotBefore: issued,
+		Exp:       issued + exp,
+		Contents:  make(map[string]string),
 	}
+	if exp > EXP_NEVER-issued {
+		t.Exp = EXP_NEVER
+	}
+	return t
 }
 
+// Sign signs the token with a shared HMAC secret.
 func (t *Token) Sign(key []byte) ([]byte, error) {
-	// Convert the token to json
-	jsonBytes, err := json.Marshal(t)
+	return t.SignWith(NewHMACKey(key))
+}
+
+// SignWith signs the token with k, using k's algorithm.
+func (t *Token) SignWith(k *Key) ([]byte, error) {
+	h, err := json.Marshal(&header{Alg: k.alg, Typ: "JWT", Kid: k.id})
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(t)
 	if err != nil {
 		return nil, err
 	}
 
-	// Convert the json bytes to base64
-	body := make([]byte, base64.URLEncoding.EncodedLen(len(jsonBytes)))
-	base64.URLEncoding.Encode(body, jsonBytes)
+	payload := b64.EncodeToString(h) + "." + b64.EncodeToString(body)
+	sig, err := k.sign([]byte(payload))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(payload + "." + b64.EncodeToString(sig)), nil
+}
 
-	// Append the body to the JWT header
-	payload := append(append(jwt_header, '.'), body...)
+// Validator checks tokens. Issuer and Audience are only checked when set.
+type Validator struct {
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
 
-	// Create an HMAC signature of the payload.
-	mac := hmac.New(sha256.New, key)
-	mac.Write(payload)
-	sig := mac.Sum(nil)
-	b64sig := make([]byte, base64.URLEncoding.EncodedLen(len(sig)))
-	base64.URLEncoding.Encode(b64sig, sig)
+// Validate checks an HMAC signed token with the default leeway and no
+// issuer or audience requirements.
+func Validate(token []byte, key []byte) (*Token, error) {
+	v := Validator{Leeway: DEFAULT_LEEWAY}
+	return v.Validate(token, key)
+}
 
-	// Append the signature and return
-	return append(append(payload, '.'), b64sig...), nil
+// Validate checks a token signed with the shared HMAC secret key.
+func (v *Validator) Validate(token []byte, key []byte) (*Token, error) {
+	return v.ValidateWith(token, NewHMACKey(key))
 }
 
-func Validate(token []byte, key []byte) (*Token, error) {
-	// Split the token by . ensuring len is 3 (toss header for now)
-	tokenPieces := bytes.Split(token, []byte{'.'})
-	if len(tokenPieces) != 3 {
+// ValidateWith checks the header, signature and claims of token and
+// returns its claims. The key is picked by the header's kid, or without
+// one, by its alg. Either way the alg must be the key's, so a token cannot
+// pick a weaker algorithm (or "none") for itself, or have an RSA public key
+// used as an HMAC secret.
+func (v *Validator) ValidateWith(token []byte, keys ...*Key) (*Token, error) {
+	pieces := bytes.Split(token, []byte{'.'})
+	if len(pieces) != 3 {
 		return nil, ERR_MALFORMED_TOKEN
 	}
 
-	// Validate the HMAC signature
-	mac := hmac.New(sha256.New, key)
-	mac.Write(tokenPieces[0])
-	mac.Write([]byte{'.'})
-	mac.Write(tokenPieces[1])
-	expectedSig := mac.Sum(nil)
-	b64expectedSig := make([]byte, base64.URLEncoding.EncodedLen(len(expectedSig)))
-	base64.URLEncoding.Encode(b64expectedSig, expectedSig)
-	if !hmac.Equal(b64expectedSig, tokenPieces[2]) {
-		return nil, ERR_INVALID_SIG
+	// Check the header before trusting anything else
+	var h header
+	if err := decode(pieces[0], &h); err != nil {
+		return nil, err
+	}
+	var key *Key
+	for _, k := range keys {
+		if h.Kid != "" && k.id == h.Kid {
+			key = k
+			break
+		}
+		if h.Kid == "" && k.alg == h.Alg {
+			key = k
+			break
+		}
+	}
+	if key == nil && h.Kid != "" {
+		return nil, ERR_UNKNOWN_KEY
+	}
+	if key == nil || key.alg != h.Alg {
+		return nil, ERR_UNSUPPORTED_ALG
+	}
+	if (h.Typ != "" && h.Typ != "JWT") || len(h.Crit) > 0 {
+		return nil, ERR_MALFORMED_TOKEN
 	}
 
-	// Decode the body into a Token
-	jsonBytes := make([]byte, base64.URLEncoding.DecodedLen(len(tokenPieces[1])))
-	_, err := base64.URLEncoding.Decode(jsonBytes, tokenPieces[1])
+	sig, err := b64.Strict().DecodeString(string(pieces[2]))
 	if err != nil {
-		return nil, err
+		return nil, ERR_MALFORMED_TOKEN
 	}
-	jsonBytes = bytes.TrimRight(jsonBytes, "\x00")
+	if !key.verify(token[:len(pieces[0])+1+len(pieces[1])], sig) {
+		return nil, ERR_INVALID_SIG
+	}
+
 	t := new(Token)
-	err = json.Unmarshal(jsonBytes[:len(jsonBytes)], t) // bytes.Split leaves null character at the end of the string that json does not like
-	if err != nil {
+	if err := decode(pieces[1], t); err != nil {
 		return nil, err
 	}
+	if t.Contents == nil {
+		t.Contents = make(map[string]string)
+	}
+	if err := v.check(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
 
-	// Check exp date
-	if t.Exp < time.Now().Unix() {
-		return nil, ERR_EXPIRED
+func (v *Validator) check(t *Token) error {
+	current := now().Unix()
+	leeway := int64(v.Leeway / time.Second)
+	if t.Exp == 0 {
+		return ERR_MALFORMED_TOKEN
+	}
+	if t.Exp < current-leeway {
+		return ERR_EXPIRED
+	}
+	if t.NotBefore > current+leeway || t.IssuedAt > current+leeway {
+		return ERR_NOT_VALID_YET
 	}
+	if v.Issuer != "" && t.Issuer != v.Issuer {
+		return ERR_WRONG_ISSUER
+	}
+	if v.Audience != "" && !t.Audience.contains(v.Audience) {
+		return ERR_WRONG_AUDIENCE
+	}
+	return nil
+}
 
-	// Return the validated token
-	return t, nil
+// decode reads a base64url encoded JSON segment. Padding is not allowed.
+func decode(segment []byte, v interface{}) error {
+	data, err := b64.Strict().DecodeString(string(segment))
+	if err != nil {
+		return ERR_MALFORMED_TOKEN
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ERR_MALFORMED_TOKEN
+	}
+	return nil
 }
@@ -1,23 +1,141 @@
 package token
 
 import (
-	"fmt"
+	"bytes"
+	"encoding/base64"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestToken(test *testing.T) {
 	t := NewToken(EXP_1DAY)
+	t.Subject = "dfindley"
+	t.Issuer = "netreg"
+	t.Audience = Audience{"netreg"}
 	t.Contents["username"] = "dfindley"
 	webtoken, err := t.Sign([]byte("secret"))
 	if err != nil {
 		test.Fatal(err)
 	}
-	fmt.Println(string(webtoken))
+	if bytes.ContainsRune(webtoken, '=') {
+		test.Fatal("Token segments should not be padded: ", string(webtoken))
+	}
 
 	// Attempt to validate token
-	vt, err := Validate(webtoken, []byte("secret"))
+	v := Validator{Issuer: "netreg", Audience: "netreg", Leeway: DEFAULT_LEEWAY}
+	vt, err := v.Validate(webtoken, []byte("secret"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if vt.Subject != "dfindley" || vt.Contents["username"] != "dfindley" || vt.ID == "" || vt.ID != t.ID {
+		test.Fatalf("Claims did not survive signing: %+v", vt)
+	}
+
+	if _, err := Validate(webtoken, []byte("wrong")); err != ERR_INVALID_SIG {
+		test.Fatal("Expected an invalid signature, got", err)
+	}
+	v.Issuer = "someone-else"
+	if _, err := v.Validate(webtoken, []byte("secret")); err != ERR_WRONG_ISSUER {
+		test.Fatal("Expected the wrong issuer, got", err)
+	}
+	v = Validator{Audience: "another-service"}
+	if _, err := v.Validate(webtoken, []byte("secret")); err != ERR_WRONG_AUDIENCE {
+		test.Fatal("Expected the wrong audience, got", err)
+	}
+}
+
+// The HS256 example from RFC 7515 appendix A.1, as produced by other JWT
+// implementations.
+func TestInterop(test *testing.T) {
+	jwt := "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ" +
+		".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	key, _ := base64.RawURLEncoding.DecodeString("AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow")
+
+	now = func() time.Time { return time.Unix(1300819000, 0) }
+	defer func() { now = time.Now }()
+	t, err := Validate([]byte(jwt), key)
 	if err != nil {
 		test.Fatal(err)
 	}
-	fmt.Printf("%v\n", vt)
+	if t.Issuer != "joe" || t.Exp != 1300819380 {
+		test.Fatalf("Wrong claims: %+v", t)
+	}
+
+	// The same token checked after it expires
+	now = func() time.Time { return time.Unix(1300819380, 0).Add(DEFAULT_LEEWAY + time.Second) }
+	if _, err := Validate([]byte(jwt), key); err != ERR_EXPIRED {
+		test.Fatal("Expected an expired token, got", err)
+	}
+}
+
+func TestTimes(test *testing.T) {
+	key := []byte("secret")
+	t := NewToken(EXP_1HOUR)
+	webtoken, _ := t.Sign(key)
+
+	// A checker whose clock is slightly behind still accepts it
+	now = func() time.Time { return time.Now().Add(-30 * time.Second) }
+	defer func() { now = time.Now }()
+	if _, err := Validate(webtoken, key); err != nil {
+		test.Fatal("Clock skew within the leeway was rejected:", err)
+	}
+	now = func() time.Time { return time.Now().Add(-time.Hour) }
+	if _, err := Validate(webtoken, key); err != ERR_NOT_VALID_YET {
+		test.Fatal("Expected a token from the future to be rejected, got", err)
+	}
+
+	if NewToken(EXP_NEVER).Exp != EXP_NEVER {
+		test.Fatal("EXP_NEVER overflowed.")
+	}
+}
+
+func TestHeaderChecks(test *testing.T) {
+	key := []byte("secret")
+	webtoken, _ := NewToken(EXP_1HOUR).Sign(key)
+	pieces := strings.Split(string(webtoken), ".")
+	enc := base64.RawURLEncoding
+
+	// Swapping the algorithm must not be accepted, even with no signature
+	none := enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + pieces[1] + "."
+	if _, err := Validate([]byte(none), key); err != ERR_UNSUPPORTED_ALG {
+		test.Fatal("Expected alg none to be rejected, got", err)
+	}
+	crit := enc.EncodeToString([]byte(`{"alg":"HS256","crit":["exp"]}`)) + "." + pieces[1] + "." + pieces[2]
+	if _, err := Validate([]byte(crit), key); err != ERR_MALFORMED_TOKEN {
+		test.Fatal("Expected unknown critical headers to be rejected, got", err)
+	}
+	padded := pieces[0] + "." + pieces[1] + "." + pieces[2] + "="
+	if _, err := Validate([]byte(padded), key); err != ERR_MALFORMED_TOKEN {
+		test.Fatal("Expected a padded signature to be rejected, got", err)
+	}
+	if _, err := Validate([]byte(pieces[0]+"."+pieces[1]), key); err != ERR_MALFORMED_TOKEN {
+		test.Fatal("Expected a token without a signature to be rejected, got", err)
+	}
+}
+
+func TestAudience(test *testing.T) {
+	var a Audience
+	if err := a.UnmarshalJSON([]byte(`"netreg"`)); err != nil || !a.contains("netreg") {
+		test.Fatal("Could not read a single audience: ", err)
+	}
+	if err := a.UnmarshalJSON([]byte(`["a","netreg"]`)); err != nil || !a.contains("netreg") || len(a) != 2 {
+		test.Fatal("Could not read a list of audiences: ", err)
+	}
+	if data, _ := (Audience{"netreg"}).MarshalJSON(); string(data) != `"netreg"` {
+		test.Fatal("A single audience should be written as a string: ", string(data))
+	}
+}
+
+func TestParseExp(test *testing.T) {
+	if exp, err := ParseExp("6hour"); err != nil || exp != EXP_6HOUR {
+		test.Fatal("Could not parse 6hour: ", err)
+	}
+	if exp, err := ParseExp("never"); err != nil || exp != EXP_NEVER {
+		test.Fatal("Could not parse never: ", err)
+	}
+	if _, err := ParseExp("5min"); err == nil {
+		test.Fatal("Expected an unknown lifetime to be rejected.")
+	}
 }
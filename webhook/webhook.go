@@ -0,0 +1,335 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	STATUS_PENDING   = "pending"
+	STATUS_DELIVERED = "delivered"
+	STATUS_FAILED    = "failed"
+)
+
+const (
+	// Give up on a delivery after this many attempts.
+	maxAttempts = 10
+	// Longest wait between two attempts.
+	maxBackoff = time.Hour
+	// Finished deliveries kept for the status API.
+	keepFinished = 200
+)
+
+// Delivery is one event on its way to one target.
+type Delivery struct {
+	ID          string
+	Target      string
+	Event       string
+	Payload     json.RawMessage
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+	Created     time.Time
+	Finished    time.Time `json:",omitempty"`
+}
+
+// Dispatcher posts events to webhook targets. Each body is signed with
+// HMAC-SHA256 of the shared secret in the X-Netreg-Signature header. Failed
+// deliveries are retried with exponential backoff, and the queue is kept in
+// a file so pending deliveries survive restarts.
+type Dispatcher struct {
+	targets    []string
+	secret     []byte
+	file       string
+	deliveries []*Delivery
+	client     *http.Client
+	backoff    time.Duration
+	wake       chan bool
+	stopChan   chan bool
+	sync.Mutex
+}
+
+func NewDispatcher(file string, targets []string, secret []byte) *Dispatcher {
+	return &Dispatcher{
+		targets:    targets,
+		secret:     secret,
+		file:       file,
+		deliveries: make([]*Delivery, 0),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		backoff:    10 * time.Second,
+		wake:       make(chan bool, 1),
+		stopChan:   make(chan bool),
+	}
+}
+
+// Load reads the queue file. A missing file is an empty queue.
+func (d *Dispatcher) Load() error {
+	d.Lock()
+	defer d.Unlock()
+	data, err := ioutil.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.deliveries)
+}
+
+func (d *Dispatcher) Start() {
+	go d.run()
+}
+
+func (d *Dispatcher) Stop() {
+	close(d.stopChan)
+}
+
+// Message is an event to deliver to every target.
+type Message struct {
+	Event   string
+	Payload interface{}
+}
+
+// Enqueue queues event with payload for every target.
+func (d *Dispatcher) Enqueue(event string, payload interface{}) error {
+	return d.EnqueueAll([]Message{{Event: event, Payload: payload}})
+}
+
+// EnqueueAll queues several messages for every target, writing the queue
+// file once for all of them.
+func (d *Dispatcher) EnqueueAll(messages []Message) error {
+	if len(d.targets) == 0 || len(messages) == 0 {
+		return nil
+	}
+	bodies := make([][]byte, len(messages))
+	for i, m := range messages {
+		body, err := json.Marshal(m.Payload)
+		if err != nil {
+			return err
+		}
+		bodies[i] = body
+	}
+
+	d.Lock()
+	now := time.Now()
+	for i, m := range messages {
+		for _, target := range d.targets {
+			d.deliveries = append(d.deliveries, &Delivery{
+				ID:          newID(),
+				Target:      target,
+				Event:       m.Event,
+				Payload:     bodies[i],
+				Status:      STATUS_PENDING,
+				NextAttempt: now,
+				Created:     now,
+			})
+		}
+	}
+	d.save()
+	d.Unlock()
+	d.poke()
+	return nil
+}
+
+// Retry schedules a failed or pending delivery for an immediate attempt.
+func (d *Dispatcher) Retry(id string) bool {
+	d.Lock()
+	found := false
+	for _, dl := range d.deliveries {
+		if dl.ID == id && dl.Status != STATUS_DELIVERED {
+			dl.Status = STATUS_PENDING
+			dl.Attempts = 0
+			dl.NextAttempt = time.Now()
+			found = true
+		}
+	}
+	if found {
+		d.save()
+	}
+	d.Unlock()
+	if found {
+		d.poke()
+	}
+	return found
+}
+
+// List returns copies of all known deliveries, newest first.
+func (d *Dispatcher) List() []Delivery {
+	d.Lock()
+	defer d.Unlock()
+	result := make([]Delivery, 0, len(d.deliveries))
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		result = append(result, *d.deliveries[i])
+	}
+	return result
+}
+
+func (d *Dispatcher) poke() {
+	select {
+	case d.wake <- true:
+	default:
+	}
+}
+
+func (d *Dispatcher) run() {
+	for {
+		next := d.deliverDue()
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(next.Sub(time.Now()))
+		}
+		select {
+		case <-timer:
+		case <-d.wake:
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+// deliverDue attempts every pending delivery that is due and returns when
+// the next one will be, or the zero time if nothing is pending.
+func (d *Dispatcher) deliverDue() time.Time {
+	d.Lock()
+	due := make([]*Delivery, 0)
+	now := time.Now()
+	for _, dl := range d.deliveries {
+		if dl.Status == STATUS_PENDING && !dl.NextAttempt.After(now) {
+			due = append(due, dl)
+		}
+	}
+	d.Unlock()
+
+	for _, dl := range due {
+		err := d.send(dl)
+
+		d.Lock()
+		dl.Attempts++
+		if err == nil {
+			dl.Status = STATUS_DELIVERED
+			dl.LastError = ""
+			dl.Finished = time.Now()
+		} else {
+			slog.Warn("Webhook delivery failed", "delivery", dl.ID, "target", dl.Target, "attempt", dl.Attempts, "error", err)
+			dl.LastError = err.Error()
+			if dl.Attempts >= maxAttempts {
+				dl.Status = STATUS_FAILED
+				dl.Finished = time.Now()
+			} else {
+				dl.NextAttempt = time.Now().Add(d.backoffFor(dl.Attempts))
+			}
+		}
+		d.Unlock()
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if len(due) > 0 {
+		d.prune()
+		d.save()
+	}
+	var next time.Time
+	for _, dl := range d.deliveries {
+		if dl.Status == STATUS_PENDING && (next.IsZero() || dl.NextAttempt.Before(next)) {
+			next = dl.NextAttempt
+		}
+	}
+	return next
+}
+
+func (d *Dispatcher) send(dl *Delivery) error {
+	req, err := http.NewRequest("POST", dl.Target, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Netreg-Event", dl.Event)
+	req.Header.Set("X-Netreg-Delivery", dl.ID)
+	req.Header.Set("X-Netreg-Signature", "sha256="+Sign(d.secret, dl.Payload))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("target answered %s", res.Status)
+	}
+	return nil
+}
+
+// backoffFor returns the wait after the given number of failed attempts.
+func (d *Dispatcher) backoffFor(attempts int) time.Duration {
+	wait := d.backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// prune drops the oldest finished deliveries beyond keepFinished. The caller
+// must hold the lock.
+func (d *Dispatcher) prune() {
+	finished := make([]*Delivery, 0)
+	for _, dl := range d.deliveries {
+		if dl.Status != STATUS_PENDING {
+			finished = append(finished, dl)
+		}
+	}
+	if len(finished) <= keepFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(finished[j].Finished) })
+	drop := make(map[*Delivery]bool)
+	for _, dl := range finished[:len(finished)-keepFinished] {
+		drop[dl] = true
+	}
+	kept := make([]*Delivery, 0, len(d.deliveries)-len(drop))
+	for _, dl := range d.deliveries {
+		if !drop[dl] {
+			kept = append(kept, dl)
+		}
+	}
+	d.deliveries = kept
+}
+
+// save writes the queue file. The caller must hold the lock.
+func (d *Dispatcher) save() {
+	data, err := json.MarshalIndent(d.deliveries, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode webhook queue", "error", err)
+		return
+	}
+	err = ioutil.WriteFile(d.file, data, 0660)
+	if err != nil {
+		slog.Error("Failed to write webhook queue", "file", d.file, "error", err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of body, as sent in X-Netreg-Signature.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
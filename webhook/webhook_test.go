@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDelivery(t *testing.T) {
+	os.Remove("TestWebhook.json")
+	secret := []byte("secret")
+
+	// Fail the first attempt, then accept
+	var lock sync.Mutex
+	calls := 0
+	received := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		first := calls == 1
+		lock.Unlock()
+		if first {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Netreg-Signature") != "sha256="+Sign(secret, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		received <- r.Header.Get("X-Netreg-Event") + " " + string(body)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher("TestWebhook.json", []string{server.URL}, secret)
+	d.backoff = 10 * time.Millisecond
+	d.Start()
+	err := d.Enqueue("add", map[string]string{"MAC": "00:00:00:00:00:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if got != `add {"MAC":"00:00:00:00:00:00"}` {
+			t.Fatal("Unexpected delivery: ", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not delivered.")
+	}
+	d.Stop()
+
+	// Wait for the result to be recorded
+	var dl Delivery
+	for i := 0; i < 100; i++ {
+		dl = d.List()[0]
+		if dl.Status != STATUS_PENDING {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dl.Status != STATUS_DELIVERED || dl.Attempts != 2 {
+		t.Fatal("Expected delivery after one retry, got ", dl.Status, " after ", dl.Attempts, " attempts.")
+	}
+
+	os.Remove("TestWebhook.json")
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	os.Remove("TestWebhookQueue.json")
+
+	// Nothing is listening, so the delivery stays pending
+	d := NewDispatcher("TestWebhookQueue.json", []string{"http://127.0.0.1:1/hook"}, []byte("secret"))
+	d.Enqueue("remove", map[string]string{"MAC": "00:00:00:00:00:00"})
+
+	d2 := NewDispatcher("TestWebhookQueue.json", nil, []byte("secret"))
+	err := d2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := d2.List()
+	if len(list) != 1 || list[0].Status != STATUS_PENDING || list[0].Event != "remove" {
+		t.Fatal("Pending delivery did not survive a restart.")
+	}
+
+	os.Remove("TestWebhookQueue.json")
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher("", nil, nil)
+	if d.backoffFor(1) != 10*time.Second || d.backoffFor(3) != 40*time.Second {
+		t.Fatal("Backoff should double with every attempt.")
+	}
+	if d.backoffFor(maxAttempts*2) != maxBackoff {
+		t.Fatal("Backoff should be capped.")
+	}
+}
+
+func TestEnqueueAll(t *testing.T) {
+	os.Remove("TestWebhookAll.json")
+	defer os.Remove("TestWebhookAll.json")
+
+	d := NewDispatcher("TestWebhookAll.json", []string{"http://127.0.0.1:1/a", "http://127.0.0.1:1/b"}, []byte("secret"))
+	err := d.EnqueueAll([]Message{
+		{Event: "add", Payload: map[string]string{"MAC": "00:00:00:00:00:00"}},
+		{Event: "remove", Payload: map[string]string{"MAC": "00:00:00:00:00:01"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.List()) != 4 {
+		t.Fatal("Expected a delivery per message and target, got ", len(d.List()))
+	}
+}